@@ -0,0 +1,361 @@
+package email
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	arcSeal             = "ARC-Seal"
+	arcMessageSignature = "ARC-Message-Signature"
+	arcAuthResults      = "ARC-Authentication-Results"
+	authResults         = "Authentication-Results"
+
+	// maxARCInstance is the most ARC sets a chain may have (RFC 8617,
+	// section 4.2.1).
+	maxARCInstance = 50
+)
+
+// ARCStatus is the validation status of an ARC chain, as described in RFC
+// 8617, section 4.4.
+type ARCStatus string
+
+const (
+	// ARCNone means the message has no ARC sets.
+	ARCNone ARCStatus = "none"
+
+	// ARCPass means every set in the chain is present and verified.
+	ARCPass ARCStatus = "pass"
+
+	// ARCFail means the chain is malformed, a signature in it did not
+	// verify, or a sealer marked it as failed.
+	ARCFail ARCStatus = "fail"
+
+	// ARCTempError means a public key could not be retrieved because of a
+	// temporary failure. Validating again later may succeed.
+	ARCTempError ARCStatus = "temperror"
+)
+
+// ARCResult is the result of validating an ARC chain.
+type ARCResult struct {
+	Status ARCStatus
+
+	// Instance is the instance number of the newest ARC set, which is also
+	// the number of sets in the chain.
+	Instance int
+
+	// Err describes why the chain did not pass. It is nil for ARCPass and
+	// ARCNone.
+	Err error
+}
+
+// ARCVerifier validates ARC chains, as described in RFC 8617, section 5.2.
+type ARCVerifier struct {
+	// Resolver is used to look up public keys. If nil, net.DefaultResolver
+	// is used.
+	Resolver TXTResolver
+}
+
+// VerifyEmail validates the ARC chain of e, which must have been parsed and
+// still hold its original data in e.Root.Raw.
+func (v *ARCVerifier) VerifyEmail(ctx context.Context, e *Email) (ARCResult, error) {
+	if e.Root == nil || e.Root.Raw == nil {
+		return ARCResult{}, ErrNoRawMessage
+	}
+	return v.Verify(ctx, e.Root.Raw), nil
+}
+
+// Verify validates the ARC chain of the message raw.
+func (v *ARCVerifier) Verify(ctx context.Context, raw []byte) ARCResult {
+	hdr, body := splitHeader(toCRLF(raw))
+	fields := splitFields(hdr)
+	sets, err := arcSets(fields)
+	if err != nil {
+		return ARCResult{Status: ARCFail, Err: err}
+	}
+	if len(sets) == 0 {
+		return ARCResult{Status: ARCNone}
+	}
+	return v.validate(ctx, sets, fields, body)
+}
+
+// validate validates the chain sets of the message with the given header
+// fields and body.
+func (v *ARCVerifier) validate(ctx context.Context, sets []arcSet, fields [][]byte, body []byte) ARCResult {
+	res := ARCResult{Instance: len(sets)}
+	fail := func(status DKIMStatus, format string, args ...interface{}) ARCResult {
+		res.Status = ARCFail
+		if status == DKIMTempError {
+			res.Status = ARCTempError
+		}
+		res.Err = fmt.Errorf("email: ARC: "+format, args...)
+		return res
+	}
+	dv := DKIMVerifier{Resolver: v.Resolver}
+
+	newest := sets[len(sets)-1]
+	seal, err := parseTags(fieldValue(newest.as))
+	if err != nil {
+		return fail(DKIMNeutral, "seal %d: %v", len(sets), err)
+	}
+	if seal["cv"] == string(ARCFail) {
+		return fail(DKIMFail, "chain marked as failed at instance %d", len(sets))
+	}
+	ams, err := parseTags(fieldValue(newest.ams))
+	if err != nil {
+		return fail(DKIMNeutral, "message signature %d: %v", len(sets), err)
+	}
+	if status, err := dv.checkSignature(ctx, newest.ams, ams, fields, body); err != nil {
+		return fail(status, "message signature %d: %v", len(sets), err)
+	}
+
+	for i := len(sets); i >= 1; i-- {
+		as := sets[i-1].as
+		tags, err := parseTags(fieldValue(as))
+		if err != nil {
+			return fail(DKIMNeutral, "seal %d: %v", i, err)
+		}
+		want := ARCPass
+		if i == 1 {
+			want = ARCNone
+		}
+		if tags["cv"] != string(want) {
+			return fail(DKIMFail, "seal %d has cv=%s, want %s", i, tags["cv"], want)
+		}
+		for _, t := range [...]string{"a", "b", "d", "s"} {
+			if _, ok := tags[t]; !ok {
+				return fail(DKIMNeutral, "seal %d: missing %s= tag", i, t)
+			}
+		}
+		h := sha256.New()
+		for j, set := range sets[:i] {
+			h.Write(canonicalHeader(set.aar, CanonRelaxed))
+			h.Write(canonicalHeader(set.ams, CanonRelaxed))
+			if j < i-1 {
+				h.Write(canonicalHeader(set.as, CanonRelaxed))
+			}
+		}
+		if status, err := dv.checkDigest(ctx, as, tags, h, CanonRelaxed); err != nil {
+			return fail(status, "seal %d: %v", i, err)
+		}
+	}
+	res.Status = ARCPass
+	return res
+}
+
+// arcSet holds the header fields of one ARC instance.
+type arcSet struct {
+	aar, ams, as []byte
+}
+
+// arcSets returns the ARC sets in fields, ordered by instance. It is an error
+// for any set to be incomplete or duplicated.
+func arcSets(fields [][]byte) ([]arcSet, error) {
+	var sets []arcSet
+	for _, f := range fields {
+		name := strings.ToLower(fieldName(f))
+		if name != strings.ToLower(arcSeal) && name != strings.ToLower(arcMessageSignature) && name != strings.ToLower(arcAuthResults) {
+			continue
+		}
+		i, err := arcInstance(f)
+		if err != nil {
+			return nil, err
+		}
+		for len(sets) < i {
+			sets = append(sets, arcSet{})
+		}
+		var dst *[]byte
+		switch name {
+		case strings.ToLower(arcSeal):
+			dst = &sets[i-1].as
+		case strings.ToLower(arcMessageSignature):
+			dst = &sets[i-1].ams
+		default:
+			dst = &sets[i-1].aar
+		}
+		if *dst != nil {
+			return nil, fmt.Errorf("email: ARC: duplicate %s for instance %d", fieldName(f), i)
+		}
+		*dst = f
+	}
+	for i, s := range sets {
+		if s.aar == nil || s.ams == nil || s.as == nil {
+			return nil, fmt.Errorf("email: ARC: incomplete set for instance %d", i+1)
+		}
+	}
+	return sets, nil
+}
+
+// arcInstance returns the value of the i= tag of the ARC header field f.
+func arcInstance(f []byte) (int, error) {
+	for _, spec := range strings.Split(fieldValue(f), ";") {
+		k := strings.IndexByte(spec, '=')
+		if k < 0 || strings.TrimSpace(spec[:k]) != "i" {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(spec[k+1:]))
+		if err != nil || i < 1 || i > maxARCInstance {
+			return 0, fmt.Errorf("email: ARC: invalid instance in %s", fieldName(f))
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("email: ARC: no instance in %s", fieldName(f))
+}
+
+var (
+	errARCChainFull    = errors.New("email: ARC chain has the maximum number of sets")
+	errARCChainChanged = errors.New("email: ARC chain differs from the one validated")
+	errARCAuthServID   = errors.New("email: ARC authserv-id must be a non-empty token")
+)
+
+// ARCSealer adds an ARC set to messages, as described in RFC 8617, section
+// 5.1. Set it in Encoder.ARC to seal messages as they are written or sent,
+// e.g. when forwarding parsed Emails.
+type ARCSealer struct {
+	// Domain, Selector, and Key are used to sign the ARC-Message-Signature
+	// and ARC-Seal fields, as for a DKIMSigner.
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+
+	// AuthServID identifies the sealer's administrative domain, e.g.
+	// "mx.example.com", and is required. The ARC-Authentication-Results
+	// field is a copy of the message's Authentication-Results field with
+	// this authserv-id, or records no results if there is none.
+	AuthServID string
+
+	// Headers lists the header fields the ARC-Message-Signature signs. If
+	// nil, those of DefaultSignedHeaders and DKIM-Signature present in the
+	// message are signed.
+	Headers []string
+
+	// Resolver is used to look up public keys to validate the message's
+	// existing ARC chain. If nil, net.DefaultResolver is used.
+	Resolver TXTResolver
+}
+
+// seal returns the header fields of a new ARC set, including trailing CRLF,
+// for msg, the message as it will be sent. The existing chain is validated on
+// orig, the message as it was received, or on msg if orig is nil. A chain
+// already marked as failed is not extended, and seal returns "".
+func (s *ARCSealer) seal(ctx context.Context, msg, orig []byte, now time.Time) (string, error) {
+	if s.AuthServID == "" || !isPrintableASCII(s.AuthServID) || strings.ContainsAny(s.AuthServID, " ;") {
+		return "", errARCAuthServID
+	}
+	algo, err := signatureAlgorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+	if orig == nil {
+		orig = msg
+	}
+	v := ARCVerifier{Resolver: s.Resolver}
+	cv := v.Verify(ctx, orig)
+	switch {
+	case cv.Status == ARCTempError:
+		return "", cv.Err
+	case cv.Status == ARCFail && cv.Instance == 0:
+		// The chain is too malformed to tell which instance comes next.
+		return "", cv.Err
+	case cv.Status == ARCFail && markedFailed(orig):
+		return "", nil
+	case cv.Instance >= maxARCInstance:
+		return "", errARCChainFull
+	}
+	i := cv.Instance + 1
+
+	hdr, body := splitHeader(msg)
+	fields := splitFields(hdr)
+
+	// A seal covers the whole chain, unless the chain failed, in which
+	// case it covers only its own set.
+	var signed [][]byte
+	status := ARCNone
+	if cv.Status == ARCPass {
+		sets, err := arcSets(fields)
+		if err != nil {
+			return "", err
+		}
+		if len(sets) != cv.Instance {
+			return "", errARCChainChanged
+		}
+		for _, set := range sets {
+			signed = append(signed, set.aar, set.ams, set.as)
+		}
+		status = ARCPass
+	} else if cv.Status == ARCFail {
+		status = ARCFail
+	}
+
+	results := s.AuthServID + "; none"
+	for _, f := range fields {
+		if !strings.EqualFold(fieldName(f), authResults) {
+			continue
+		}
+		v := strings.TrimSpace(strings.Replace(fieldValue(f), lineEnding, "", -1))
+		if id := strings.Fields(strings.SplitN(v, ";", 2)[0]); len(id) > 0 && strings.EqualFold(id[0], s.AuthServID) {
+			results = v
+			break
+		}
+	}
+	aar := foldHeader(arcAuthResults, fmt.Sprintf("i=%d; %s", i, results)) + lineEnding
+
+	names := s.Headers
+	if names == nil {
+		names = presentFields(fields, append(DefaultSignedHeaders[:len(DefaultSignedHeaders):len(DefaultSignedHeaders)], dkimSignature))
+	}
+	bh := sha256.Sum256(canonicalBody(body, CanonRelaxed))
+	ams, err := signHeader(s.Key, arcMessageSignature, []string{
+		fmt.Sprintf("i=%d", i),
+		"a=" + algo,
+		"c=relaxed/relaxed",
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		fmt.Sprintf("t=%d", now.Unix()),
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bh[:]),
+	}, selectFields(fields, names), CanonRelaxed)
+	if err != nil {
+		return "", err
+	}
+
+	signed = append(signed, []byte(aar), []byte(ams))
+	as, err := signHeader(s.Key, arcSeal, []string{
+		fmt.Sprintf("i=%d", i),
+		"a=" + algo,
+		"cv=" + string(status),
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		fmt.Sprintf("t=%d", now.Unix()),
+	}, signed, CanonRelaxed)
+	if err != nil {
+		return "", err
+	}
+	return as + ams + aar, nil
+}
+
+// markedFailed reports whether the newest ARC-Seal in msg has cv=fail.
+func markedFailed(msg []byte) bool {
+	hdr, _ := splitHeader(toCRLF(msg))
+	newest, cv := 0, ""
+	for _, f := range splitFields(hdr) {
+		if !strings.EqualFold(fieldName(f), arcSeal) {
+			continue
+		}
+		i, err := arcInstance(f)
+		if err != nil || i <= newest {
+			continue
+		}
+		if tags, err := parseTags(fieldValue(f)); err == nil {
+			newest, cv = i, tags["cv"]
+		}
+	}
+	return cv == string(ARCFail)
+}
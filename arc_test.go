@@ -0,0 +1,152 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestARC(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}
+	keys := txtRecords{
+		"ed._domainkey.example.com": record,
+		"ed._domainkey.example.org": record,
+	}
+	seal := func(e *Email, s *ARCSealer) []byte {
+		t.Helper()
+		enc := testEncoder()
+		enc.ARC = s
+		var buf bytes.Buffer
+		if _, err := enc.Encode(&buf, e); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	parse := func(msg []byte) *Email {
+		t.Helper()
+		e, err := New(bytes.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	verify := func(msg []byte) ARCResult {
+		v := ARCVerifier{Resolver: keys}
+		return v.Verify(context.Background(), msg)
+	}
+	first := &ARCSealer{Domain: "example.com", Selector: "ed", Key: key, AuthServID: "mx.example.com", Resolver: keys}
+	second := &ARCSealer{Domain: "example.org", Selector: "ed", Key: key, AuthServID: "mx.example.org", Resolver: keys}
+
+	e := dummyEmail
+	e.Headers = map[string][]string{authResults: {"mx.example.com; spf=pass smtp.mailfrom=example.com"}}
+	hop1 := seal(&e, first)
+	if r := verify(hop1); r.Status != ARCPass || r.Instance != 1 {
+		t.Fatalf("first hop: %s at %d: %v", r.Status, r.Instance, r.Err)
+	}
+	for _, want := range []string{
+		"ARC-Seal: i=1; a=ed25519-sha256; cv=none;",
+		"ARC-Authentication-Results: i=1; mx.example.com; spf=pass smtp.mailfrom=example.com\r\n",
+	} {
+		if !bytes.Contains(unfold(hop1), []byte(want)) {
+			t.Errorf("first hop has no %q:\n%s", want, hop1)
+		}
+	}
+
+	hop2 := seal(parse(hop1), second)
+	if r := verify(hop2); r.Status != ARCPass || r.Instance != 2 {
+		t.Fatalf("second hop: %s at %d: %v", r.Status, r.Instance, r.Err)
+	}
+	for _, want := range []string{
+		"ARC-Seal: i=2; a=ed25519-sha256; cv=pass;",
+		"ARC-Authentication-Results: i=2; mx.example.org; none\r\n",
+	} {
+		if !bytes.Contains(unfold(hop2), []byte(want)) {
+			t.Errorf("second hop has no %q:\n%s", want, hop2)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		msg    []byte
+		status ARCStatus
+	}{
+		{"no chain", seal(&e, nil), ARCNone},
+		{"bare LF", bytes.Replace(hop2, []byte("\r\n"), []byte("\n"), -1), ARCPass},
+		{"modified body", bytes.Replace(hop2, []byte("Fancy"), []byte("Plain"), 1), ARCFail},
+		{"modified results", bytes.Replace(hop2, []byte("spf=pass"), []byte("spf=fail"), 1), ARCFail},
+		{"missing set", bytes.Replace(hop2, []byte("ARC-Seal: i=1"), []byte("X-Seal: i=1"), 1), ARCFail},
+		{"DNS failure", seal(&e, &ARCSealer{Domain: "example.com", Selector: "tempfail", Key: key, AuthServID: "mx.example.com"}), ARCTempError},
+	}
+	for _, tt := range tests {
+		if r := verify(tt.msg); r.Status != tt.status {
+			t.Errorf("%s: status %s (%v), want %s", tt.name, r.Status, r.Err, tt.status)
+		}
+	}
+
+	// A broken chain is sealed once as failed and then left alone.
+	broken := bytes.Replace(hop1, []byte("spf=pass"), []byte("spf=fail"), 1)
+	hop2 = seal(parse(broken), second)
+	if !bytes.Contains(unfold(hop2), []byte("ARC-Seal: i=2; a=ed25519-sha256; cv=fail;")) {
+		t.Errorf("failed chain not sealed with cv=fail:\n%s", hop2)
+	}
+	if r := verify(hop2); r.Status != ARCFail {
+		t.Errorf("failed chain: status %s", r.Status)
+	}
+	hop3 := seal(parse(hop2), first)
+	if n := strings.Count(string(hop3), "ARC-Seal:"); n != 2 {
+		t.Errorf("failed chain extended to %d sets", n)
+	}
+
+	enc := testEncoder()
+	enc.ARC = &ARCSealer{Domain: "example.com", Selector: "ed", Key: key, AuthServID: "mx.example.com", Resolver: keys}
+	tempfail := seal(&e, &ARCSealer{Domain: "example.com", Selector: "tempfail", Key: key, AuthServID: "mx.example.com"})
+	if _, err := enc.Encode(new(bytes.Buffer), parse(tempfail)); err == nil {
+		t.Error("sealed a chain that could not be validated")
+	}
+
+	// The context given to EncodeContext reaches the lookups.
+	enc.ARC.Resolver = ctxRecords(keys)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := enc.EncodeContext(ctx, new(bytes.Buffer), parse(hop1)); err == nil {
+		t.Error("sealed a chain validated with a canceled context")
+	}
+	if _, err := enc.EncodeContext(context.Background(), new(bytes.Buffer), parse(hop1)); err != nil {
+		t.Error(err)
+	}
+
+	for _, id := range []string{"", "mx.example.com; spf=pass", "mx example.com"} {
+		enc.ARC.AuthServID = id
+		if _, err := enc.Encode(new(bytes.Buffer), &e); err != errARCAuthServID {
+			t.Errorf("authserv-id %q: expected errARCAuthServID, got %v", id, err)
+		}
+	}
+	enc.ARC = &ARCSealer{Domain: "example.com", Selector: "ed", AuthServID: "mx.example.com", Resolver: keys}
+	if _, err := enc.Encode(new(bytes.Buffer), &e); err != errDKIMKey {
+		t.Errorf("expected errDKIMKey, got %v", err)
+	}
+}
+
+// ctxRecords is a txtRecords whose lookups fail once their context is done.
+type ctxRecords txtRecords
+
+func (r ctxRecords) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, IsTimeout: true}
+	}
+	return txtRecords(r).LookupTXT(ctx, name)
+}
+
+// unfold removes folding from the header fields of msg.
+func unfold(msg []byte) []byte {
+	return bytes.Replace(msg, []byte("\r\n "), []byte(" "), -1)
+}
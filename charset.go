@@ -0,0 +1,376 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// errUnknownCharset is returned by charsetReader for character sets that are
+// neither built in nor supported by Parser.CharsetReader.
+var errUnknownCharset = errors.New("email: unsupported charset")
+
+// textParams returns the Content-Type parameters for a text body in the given
+// charset, defaulting to UTF-8.
+func textParams(charset string) map[string]string {
+	if charset == "" {
+		charset = "UTF-8"
+	}
+	return map[string]string{"charset": charset}
+}
+
+// decodeCharset returns body converted from charset to UTF-8, along with the
+// name of the character set it is in. The name is empty if the result is
+// UTF-8.
+func (p *Parser) decodeCharset(body []byte, charset string) ([]byte, string) {
+	if isUTF8(charset) {
+		return body, ""
+	}
+	if p.RawCharset {
+		return body, charset
+	}
+	r, err := p.charsetReader(charset, bytes.NewReader(body))
+	if err != nil {
+		return body, charset
+	}
+	conv, err := ioutil.ReadAll(r)
+	if err != nil {
+		return body, charset
+	}
+	return conv, ""
+}
+
+// isUTF8 reports whether text in charset may be used as UTF-8 without
+// conversion. An empty charset is treated as US-ASCII, per RFC 2045.
+func isUTF8(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+// charsetReader returns a reader that converts input from charset to UTF-8.
+// Common single-byte character sets, Japanese (ISO-2022-JP, Shift_JIS, and
+// EUC-JP), and Simplified Chinese (GB 2312) are built in; other character
+// sets are handed to p.CharsetReader.
+func (p *Parser) charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	if isUTF8(charset) {
+		return input, nil
+	}
+	if cm, ok := charmaps[strings.ToLower(charset)]; ok {
+		return &charmapReader{cm: cm, r: input}, nil
+	}
+	if dec, ok := multibyte[strings.ToLower(charset)]; ok {
+		b, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(dec(b)), nil
+	}
+	if p.CharsetReader != nil {
+		return p.CharsetReader(charset, input)
+	}
+	return nil, errUnknownCharset
+}
+
+// charmap maps the upper half of a single-byte character set to runes. The
+// lower half is always US-ASCII.
+type charmap [128]rune
+
+var latin1, latin9, cp1252 charmap
+
+var charmaps = map[string]*charmap{
+	"iso-8859-1":   &latin1,
+	"iso8859-1":    &latin1,
+	"iso_8859-1":   &latin1,
+	"latin1":       &latin1,
+	"l1":           &latin1,
+	"iso-8859-2":   latin2,
+	"iso8859-2":    latin2,
+	"iso_8859-2":   latin2,
+	"latin2":       latin2,
+	"l2":           latin2,
+	"iso-8859-5":   isoCyrillic,
+	"iso8859-5":    isoCyrillic,
+	"iso_8859-5":   isoCyrillic,
+	"cyrillic":     isoCyrillic,
+	"iso-8859-7":   isoGreek,
+	"iso8859-7":    isoGreek,
+	"iso_8859-7":   isoGreek,
+	"greek":        isoGreek,
+	"iso-8859-9":   latin5,
+	"iso8859-9":    latin5,
+	"iso_8859-9":   latin5,
+	"latin5":       latin5,
+	"l5":           latin5,
+	"iso-8859-15":  &latin9,
+	"iso8859-15":   &latin9,
+	"latin-9":      &latin9,
+	"koi8-r":       koi8r,
+	"cskoi8r":      koi8r,
+	"koi8-u":       koi8u,
+	"windows-1250": cp1250,
+	"cp1250":       cp1250,
+	"windows-1251": cp1251,
+	"cp1251":       cp1251,
+	"windows-1252": &cp1252,
+	"cp1252":       &cp1252,
+}
+
+// newCharmap returns the charmap whose upper half is upper, which must hold
+// 128 characters.
+func newCharmap(upper string) *charmap {
+	var cm charmap
+	i := 0
+	for _, r := range upper {
+		cm[i] = r
+		i++
+	}
+	if i != len(cm) {
+		panic("email: charmap must have 128 characters")
+	}
+	return &cm
+}
+
+func init() {
+	for i := range latin1 {
+		latin1[i] = rune(0x80 + i)
+	}
+	latin9, cp1252 = latin1, latin1
+
+	// ISO-8859-15 replaces eight Latin-1 characters.
+	for b, r := range map[byte]rune{
+		0xa4: '€', 0xa6: 'Š', 0xa8: 'š', 0xb4: 'Ž',
+		0xb8: 'ž', 0xbc: 'Œ', 0xbd: 'œ', 0xbe: 'Ÿ',
+	} {
+		latin9[b-0x80] = r
+	}
+
+	// Windows-1252 assigns printable characters to most of the C1 controls.
+	copy(cp1252[:32], []rune{
+		'€', '\ufffd', '‚', 'ƒ', '„', '…', '†', '‡',
+		'ˆ', '‰', 'Š', '‹', 'Œ', '\ufffd', 'Ž', '\ufffd',
+		'\ufffd', '‘', '’', '“', '”', '•', '–', '—',
+		'˜', '™', 'š', '›', 'œ', '\ufffd', 'ž', 'Ÿ',
+	})
+}
+
+// charmapReader converts a single-byte character set to UTF-8.
+type charmapReader struct {
+	cm  *charmap
+	r   io.Reader
+	buf []byte // converted but unread
+}
+
+func (c *charmapReader) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		var in [512]byte
+		n, err := c.r.Read(in[:])
+		c.buf = c.buf[:0]
+		for _, b := range in[:n] {
+			if b < utf8.RuneSelf {
+				c.buf = append(c.buf, b)
+				continue
+			}
+			var enc [utf8.UTFMax]byte
+			m := utf8.EncodeRune(enc[:], c.cm[b-0x80])
+			c.buf = append(c.buf, enc[:m]...)
+		}
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// multibyte maps the names of the built-in multibyte character sets to
+// functions that convert text in them to UTF-8. Invalid or unassigned
+// sequences are converted to U+FFFD.
+var multibyte = map[string]func([]byte) []byte{
+	"iso-2022-jp":         decodeISO2022JP,
+	"csiso2022jp":         decodeISO2022JP,
+	"shift_jis":           decodeShiftJIS,
+	"shift-jis":           decodeShiftJIS,
+	"sjis":                decodeShiftJIS,
+	"x-sjis":              decodeShiftJIS,
+	"ms_kanji":            decodeShiftJIS,
+	"csshiftjis":          decodeShiftJIS,
+	"windows-31j":         decodeShiftJIS,
+	"cp932":               decodeShiftJIS,
+	"euc-jp":              decodeEUCJP,
+	"x-euc-jp":            decodeEUCJP,
+	"cseucpkdfmtjapanese": decodeEUCJP,
+	"gb2312":              decodeEUCCN,
+	"euc-cn":              decodeEUCCN,
+	"csgb2312":            decodeEUCCN,
+}
+
+// doubleByte maps the 94×94 code points of a double-byte character set such
+// as JIS X 0208, row by row, to runes. Unassigned code points are zero.
+type doubleByte [94 * 94]rune
+
+// newDoubleByte returns the doubleByte whose row n is rows[n], as described
+// in charset_tables.go.
+func newDoubleByte(rows []string) *doubleByte {
+	var d doubleByte
+	for row, s := range rows {
+		col := 0
+		for _, r := range s {
+			if r != utf8.RuneError {
+				d[(row-1)*94+col] = r
+			}
+			col++
+		}
+	}
+	return &d
+}
+
+// rune returns the character at row and col, both counted from 1, or U+FFFD
+// if there is none.
+func (d *doubleByte) rune(row, col int) rune {
+	if row < 1 || row > 94 || col < 1 || col > 94 {
+		return utf8.RuneError
+	}
+	if r := d[(row-1)*94+col-1]; r != 0 {
+		return r
+	}
+	return utf8.RuneError
+}
+
+// decodeISO2022JP converts ISO-2022-JP, as described in RFC 1468, to UTF-8.
+// Half-width katakana, which mail software sometimes sends with ESC ( I, are
+// accepted too.
+func decodeISO2022JP(b []byte) []byte {
+	const (
+		ascii = iota
+		jis
+		katakana
+		other // a double-byte set that is not supported, e.g. JIS X 0212
+	)
+	var out bytes.Buffer
+	mode := ascii
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c == 0x1b {
+			seq := b[i+1:]
+			switch {
+			case bytes.HasPrefix(seq, []byte("(B")), bytes.HasPrefix(seq, []byte("(J")):
+				mode = ascii
+			case bytes.HasPrefix(seq, []byte("$@")), bytes.HasPrefix(seq, []byte("$B")):
+				mode = jis
+			case bytes.HasPrefix(seq, []byte("(I")):
+				mode = katakana
+			case bytes.HasPrefix(seq, []byte("$(")) && len(seq) > 2:
+				mode = other
+				i++
+			default:
+				out.WriteRune(utf8.RuneError)
+				continue
+			}
+			i += 2
+			continue
+		}
+		switch {
+		case c >= utf8.RuneSelf:
+			out.WriteRune(utf8.RuneError)
+		case mode == ascii || c < 0x21 || c == 0x7f:
+			out.WriteByte(c)
+		case mode == katakana:
+			if c > 0x5f {
+				out.WriteRune(utf8.RuneError)
+			} else {
+				out.WriteRune(0xff61 + rune(c-0x21))
+			}
+		case i+1 < len(b) && 0x21 <= b[i+1] && b[i+1] <= 0x7e:
+			if mode == jis {
+				out.WriteRune(jis0208.rune(int(c)-0x20, int(b[i+1])-0x20))
+			} else {
+				out.WriteRune(utf8.RuneError)
+			}
+			i++
+		default:
+			out.WriteRune(utf8.RuneError)
+		}
+	}
+	return out.Bytes()
+}
+
+// decodeShiftJIS converts Shift_JIS to UTF-8.
+func decodeShiftJIS(b []byte) []byte {
+	var out bytes.Buffer
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c < utf8.RuneSelf:
+			out.WriteByte(c)
+		case 0xa1 <= c && c <= 0xdf:
+			out.WriteRune(0xff61 + rune(c-0xa1))
+		case (0x81 <= c && c <= 0x9f || 0xe0 <= c && c <= 0xfc) && i+1 < len(b):
+			t := b[i+1]
+			if t < 0x40 || t == 0x7f || t > 0xfc {
+				// The lead byte is invalid; the next byte may not be.
+				out.WriteRune(utf8.RuneError)
+				continue
+			}
+			i++
+			// Each lead byte covers two rows of JIS X 0208.
+			lead, trail := int(c)-0x81, int(t)-0x40
+			if c >= 0xe0 {
+				lead = int(c) - 0xc1
+			}
+			if t > 0x7f {
+				trail--
+			}
+			cell := lead*188 + trail
+			out.WriteRune(jis0208.rune(cell/94+1, cell%94+1))
+		default:
+			out.WriteRune(utf8.RuneError)
+		}
+	}
+	return out.Bytes()
+}
+
+// decodeEUCJP converts EUC-JP to UTF-8.
+func decodeEUCJP(b []byte) []byte {
+	return decodeEUC(b, jis0208, true)
+}
+
+// decodeEUCCN converts EUC-CN, the usual encoding of GB 2312, to UTF-8.
+func decodeEUCCN(b []byte) []byte {
+	return decodeEUC(b, gb2312, false)
+}
+
+// decodeEUC converts text in the Extended Unix Code encoding of d to UTF-8.
+// If japanese is set, the single shifts of EUC-JP are understood: SS2 for
+// half-width katakana and SS3 for JIS X 0212, which is not supported.
+func decodeEUC(b []byte, d *doubleByte, japanese bool) []byte {
+	isTrail := func(i int) bool {
+		return i < len(b) && 0xa1 <= b[i] && b[i] <= 0xfe
+	}
+	var out bytes.Buffer
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c < utf8.RuneSelf:
+			out.WriteByte(c)
+		case japanese && c == 0x8e && isTrail(i+1) && b[i+1] <= 0xdf:
+			out.WriteRune(0xff61 + rune(b[i+1]-0xa1))
+			i++
+		case japanese && c == 0x8f && isTrail(i+1) && isTrail(i+2):
+			out.WriteRune(utf8.RuneError)
+			i += 2
+		case 0xa1 <= c && c <= 0xfe && isTrail(i+1):
+			out.WriteRune(d.rune(int(c)-0xa0, int(b[i+1])-0xa0))
+			i++
+		default:
+			out.WriteRune(utf8.RuneError)
+		}
+	}
+	return out.Bytes()
+}
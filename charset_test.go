@@ -0,0 +1,117 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func charsetMessage(charset string, body []byte) string {
+	return "From: foo@example.com\r\n" +
+		"Content-Type: text/plain; charset=" + charset + "\r\n" +
+		"\r\n" + string(body)
+}
+
+func TestParser_Charset(t *testing.T) {
+	tests := []struct {
+		charset string
+		body    []byte
+		want    string
+	}{
+		{"us-ascii", []byte("plain"), "plain"},
+		{"UTF-8", []byte("gr\xc3\xbc\xc3\x9f"), "grüß"},
+		{"iso-8859-1", []byte("gr\xfc\xdf"), "grüß"},
+		{`"ISO-8859-15"`, []byte("\xa4 5"), "€ 5"},
+		{"windows-1252", []byte("\x93quoted\x94 \x80"), "“quoted” €"},
+		{"iso-8859-2", []byte("Za\xbf\xf3\xb3\xe6"), "Zażółć"},
+		{"iso-8859-7", []byte("\xc5\xeb\xeb\xdc\xe4\xe1"), "Ελλάδα"},
+		{"KOI8-R", []byte("\xf0\xd2\xc9\xd7\xc5\xd4"), "Привет"},
+		{"windows-1251", []byte("\xcf\xf0\xe8\xe2\xe5\xf2"), "Привет"},
+		{"ISO-2022-JP", []byte("\x1b$B$3$s$K$A$O\x1b(B, \x1b$BF|K\\8l\x1b(B"), "こんにちは, 日本語"},
+		{"Shift_JIS", []byte("\x93\xfa\x96{\x8c\xea\xb1\x87@"), "日本語ｱ①"},
+		{"EUC-JP", []byte("\xc6\xfc\xcb\xdc\xb8\xec\x8e\xb1"), "日本語ｱ"},
+		{"gb2312", []byte("\xd6\xd0\xce\xc4"), "中文"},
+		// Invalid sequences are replaced rather than dropped.
+		{"shift_jis", []byte("a\x81 b\xfd"), "a\ufffd b\ufffd"},
+		{"iso-2022-jp", []byte("\x1b$B$3\x1b(Bx\x1b$B$"), "こx\ufffd"},
+	}
+	for _, tt := range tests {
+		e, err := New(strings.NewReader(charsetMessage(tt.charset, tt.body)))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.charset, err)
+		}
+		if string(e.Text) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.charset, e.Text, tt.want)
+		}
+		if e.TextCharset != "" {
+			t.Errorf("%s: TextCharset should be empty, got %q", tt.charset, e.TextCharset)
+		}
+	}
+
+	// The same character sets are understood in encoded-words.
+	msg := "Subject: =?ISO-2022-JP?B?GyRCJDMkcyRLJEEkTxsoQg==?=\r\n" + charsetMessage("us-ascii", nil)
+	e, err := New(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Subject != "こんにちは" {
+		t.Errorf("wrong subject: %q", e.Subject)
+	}
+}
+
+func TestParser_RawCharset(t *testing.T) {
+	body := []byte("gr\xfc\xdf")
+	p := Parser{RawCharset: true}
+	e, err := p.Parse(strings.NewReader(charsetMessage("iso-8859-1", body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(e.Text, body) {
+		t.Errorf("body was converted: %q", e.Text)
+	}
+	if e.TextCharset != "iso-8859-1" {
+		t.Errorf("wrong TextCharset: %q", e.TextCharset)
+	}
+
+	// The original charset survives being written back out.
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte("text/plain; charset=iso-8859-1")) {
+		t.Errorf("charset not written:\n%s", raw)
+	}
+}
+
+func TestParser_CharsetReader(t *testing.T) {
+	body := []byte("\xbe\xc8\xb3\xe7")
+	msg := charsetMessage("EUC-KR", body)
+
+	// Without a CharsetReader the body is kept and its charset reported.
+	e, err := New(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(e.Text, body) || e.TextCharset != "EUC-KR" {
+		t.Errorf("unexpected result: %q %q", e.Text, e.TextCharset)
+	}
+
+	var called string
+	p := Parser{
+		CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+			called = charset
+			return strings.NewReader("안녕"), nil
+		},
+	}
+	e, err = p.Parse(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called != "EUC-KR" {
+		t.Errorf("CharsetReader called with %q", called)
+	}
+	if string(e.Text) != "안녕" || e.TextCharset != "" {
+		t.Errorf("unexpected result: %q %q", e.Text, e.TextCharset)
+	}
+}
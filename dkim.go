@@ -0,0 +1,750 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dkimSignature = "DKIM-Signature"
+
+// Canonicalization is a DKIM canonicalization algorithm, as described in RFC
+// 6376, section 3.4.
+type Canonicalization string
+
+const (
+	// CanonSimple tolerates almost no modification of the message.
+	CanonSimple Canonicalization = "simple"
+
+	// CanonRelaxed tolerates changes to whitespace, line folding, and the
+	// case of header field names.
+	CanonRelaxed Canonicalization = "relaxed"
+)
+
+// DefaultSignedHeaders are the header fields a DKIMSigner signs if its Headers
+// is nil, as far as they are present in the message.
+var DefaultSignedHeaders = []string{
+	from, "Sender", "Reply-To", to, cc, subject, date, msgID,
+	"In-Reply-To", "References", "List-Id", "List-Unsubscribe",
+	mimeVers, contentType, contentXferEncoding,
+}
+
+var (
+	errDKIMNoFrom = errors.New("email: DKIM signed headers must include From")
+	errDKIMKey    = errors.New("email: DKIM key must be RSA or Ed25519")
+)
+
+// DKIMSigner signs messages with DKIM, as described in RFC 6376. Set it in
+// Encoder.DKIM to sign messages as they are written or sent.
+type DKIMSigner struct {
+	// Domain and Selector locate the public key in DNS, at
+	// Selector._domainkey.Domain. They are the d= and s= tags.
+	Domain   string
+	Selector string
+
+	// Key is the private key, an *rsa.PrivateKey for rsa-sha256 or an
+	// ed25519.PrivateKey for ed25519-sha256 (RFC 8463).
+	Key crypto.Signer
+
+	// HeaderCanonicalization and BodyCanonicalization default to
+	// CanonRelaxed.
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+
+	// Headers lists the header fields to sign, which must include From. A
+	// field listed more times than it occurs is signed as absent, so that it
+	// cannot be added without breaking the signature. If nil, those of
+	// DefaultSignedHeaders present in the message are signed.
+	Headers []string
+
+	// BodyLength, if true, records the length of the signed body in the l=
+	// tag. Verifiers then ignore anything appended to the body, such as a
+	// mailing list footer, which also means it is not protected.
+	BodyLength bool
+
+	// Expiration, if non-zero, sets the x= tag to the signing time plus
+	// Expiration, after which verifiers treat the signature as invalid.
+	Expiration time.Duration
+}
+
+// sign returns the DKIM-Signature header field, including its trailing CRLF,
+// for msg, a complete message with CRLF line endings, signed at time now.
+func (s *DKIMSigner) sign(msg []byte, now time.Time) (string, error) {
+	algo, err := signatureAlgorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+	hc, bc := s.HeaderCanonicalization, s.BodyCanonicalization
+	if hc == "" {
+		hc = CanonRelaxed
+	}
+	if bc == "" {
+		bc = CanonRelaxed
+	}
+
+	hdr, body := splitHeader(msg)
+	fields := splitFields(hdr)
+	names := s.Headers
+	if names == nil {
+		names = presentFields(fields, DefaultSignedHeaders)
+	}
+	signsFrom := false
+	for _, name := range names {
+		if strings.EqualFold(name, from) {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return "", errDKIMNoFrom
+	}
+
+	cbody := canonicalBody(body, bc)
+	bh := sha256.Sum256(cbody)
+
+	tags := []string{
+		"v=1",
+		"a=" + algo,
+		"c=" + string(hc) + "/" + string(bc),
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		fmt.Sprintf("t=%d", now.Unix()),
+	}
+	if s.Expiration != 0 {
+		tags = append(tags, fmt.Sprintf("x=%d", now.Add(s.Expiration).Unix()))
+	}
+	if s.BodyLength {
+		tags = append(tags, fmt.Sprintf("l=%d", len(cbody)))
+	}
+	tags = append(tags,
+		"h="+strings.Join(names, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bh[:]),
+	)
+	return signHeader(s.Key, dkimSignature, tags, selectFields(fields, names), hc)
+}
+
+// signatureAlgorithm returns the DKIM signing algorithm, the a= tag, for key.
+func signatureAlgorithm(key crypto.Signer) (string, error) {
+	if key == nil {
+		return "", errDKIMKey
+	}
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", errDKIMKey
+}
+
+// signHeader returns the header field name, including its trailing CRLF,
+// holding tags and a b= tag with key's signature. As described in RFC 6376,
+// section 3.7, the signature covers the fields in signed and then the new
+// field itself with an empty b= tag, canonicalized with c.
+func signHeader(key crypto.Signer, name string, tags []string, signed [][]byte, c Canonicalization) (string, error) {
+	algo, err := signatureAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+	unsigned := foldHeader(name, strings.Join(append(tags[:len(tags):len(tags)], "b="), "; "))
+
+	h := sha256.New()
+	for _, f := range signed {
+		h.Write(canonicalHeader(f, c))
+	}
+	h.Write(bytes.TrimSuffix(canonicalHeader([]byte(unsigned), c), []byte(lineEnding)))
+
+	opts := crypto.Hash(0) // Ed25519 signs the digest itself.
+	if algo == "rsa-sha256" {
+		opts = crypto.SHA256
+	}
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return "", err
+	}
+	return appendFolded(unsigned, base64.StdEncoding.EncodeToString(sig)) + lineEnding, nil
+}
+
+// appendFolded appends v, which has no whitespace, to the header field line
+// s, breaking it over as many lines as needed. Whitespace in the b= tag is
+// ignored by verifiers.
+func appendFolded(s, v string) string {
+	col := len(s)
+	if i := strings.LastIndex(s, lineEnding); i >= 0 {
+		col -= i + len(lineEnding)
+	}
+	var b strings.Builder
+	b.WriteString(s)
+	for len(v) > 0 {
+		if col >= maxHeaderLine {
+			b.WriteString(lineEnding + " ")
+			col = 1
+		}
+		n := maxHeaderLine - col
+		if n > len(v) {
+			n = len(v)
+		}
+		b.WriteString(v[:n])
+		v, col = v[n:], col+n
+	}
+	return b.String()
+}
+
+// splitFields splits a message header into its fields, each including its
+// continuation lines and trailing line break. The empty line ending the
+// header is dropped.
+func splitFields(hdr []byte) [][]byte {
+	var (
+		fields [][]byte
+		start  = -1 // start of the current field
+	)
+	for i := 0; i < len(hdr); {
+		end := len(hdr)
+		if j := bytes.IndexByte(hdr[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+		if c := hdr[i]; c != ' ' && c != '\t' {
+			if start >= 0 {
+				fields = append(fields, hdr[start:i])
+			}
+			start = i
+			if len(bytes.TrimRight(hdr[i:end], "\r\n")) == 0 {
+				start = -1
+				break
+			}
+		}
+		i = end
+	}
+	if start >= 0 {
+		fields = append(fields, hdr[start:])
+	}
+	return fields
+}
+
+// fieldName returns the name of the header field f.
+func fieldName(f []byte) string {
+	if i := bytes.IndexByte(f, ':'); i >= 0 {
+		return string(bytes.TrimRight(f[:i], " \t"))
+	}
+	return ""
+}
+
+// presentFields returns those of names that occur in fields.
+func presentFields(fields [][]byte, names []string) []string {
+	var present []string
+	for _, name := range names {
+		for _, f := range fields {
+			if strings.EqualFold(fieldName(f), name) {
+				present = append(present, name)
+				break
+			}
+		}
+	}
+	return present
+}
+
+// selectFields returns the fields named by names, as described in RFC 6376,
+// section 5.4.2: each occurrence of a name selects the last instance of the
+// field not yet selected. Names with no instances left select nothing.
+func selectFields(fields [][]byte, names []string) [][]byte {
+	used := make([]bool, len(fields))
+	var sel [][]byte
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				sel = append(sel, fields[i])
+				break
+			}
+		}
+	}
+	return sel
+}
+
+// canonicalHeader canonicalizes the header field f, which includes its line
+// break, as described in RFC 6376, section 3.4.
+func canonicalHeader(f []byte, c Canonicalization) []byte {
+	if c != CanonRelaxed {
+		return f
+	}
+	i := bytes.IndexByte(f, ':')
+	if i < 0 {
+		return f
+	}
+	name := strings.ToLower(strings.TrimRight(string(f[:i]), " \t"))
+	value := bytes.Replace(f[i+1:], []byte("\r\n"), nil, -1)
+	value = bytes.Replace(value, []byte("\n"), nil, -1)
+	value = bytes.Trim(collapseWSP(value), " ")
+	return append(append([]byte(name+":"), value...), lineEnding...)
+}
+
+// canonicalBody canonicalizes a message body as described in RFC 6376,
+// section 3.4.
+func canonicalBody(body []byte, c Canonicalization) []byte {
+	var b bytes.Buffer
+	for _, line := range bytes.Split(body, []byte(lineEnding)) {
+		if c == CanonRelaxed {
+			line = bytes.TrimRight(collapseWSP(line), " ")
+		}
+		b.Write(line)
+		b.WriteString(lineEnding)
+	}
+	out := b.Bytes()
+	for bytes.HasSuffix(out, []byte(lineEnding+lineEnding)) {
+		out = out[:len(out)-len(lineEnding)]
+	}
+	if c == CanonRelaxed && len(out) == len(lineEnding) {
+		// Only empty lines: the body is empty.
+		return nil
+	}
+	return out
+}
+
+// collapseWSP replaces each run of spaces and tabs in b with a single space.
+func collapseWSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	wsp := false
+	for _, c := range b {
+		if c == ' ' || c == '\t' {
+			if !wsp {
+				out = append(out, ' ')
+			}
+			wsp = true
+			continue
+		}
+		out = append(out, c)
+		wsp = false
+	}
+	return out
+}
+
+// DKIMStatus is the outcome of verifying a DKIM signature. The values are
+// those used in Authentication-Results header fields (RFC 8601).
+type DKIMStatus string
+
+const (
+	// DKIMPass means the signature verified.
+	DKIMPass DKIMStatus = "pass"
+
+	// DKIMFail means the signature did not verify: the message was
+	// modified, the signature has expired, or it was forged.
+	DKIMFail DKIMStatus = "fail"
+
+	// DKIMNeutral means the signature could not be processed, e.g. because
+	// it is malformed or uses an unsupported algorithm.
+	DKIMNeutral DKIMStatus = "neutral"
+
+	// DKIMTempError means the public key could not be retrieved because of
+	// a temporary failure, such as a DNS timeout. Verifying again later may
+	// succeed.
+	DKIMTempError DKIMStatus = "temperror"
+
+	// DKIMPermError means the public key does not exist, is revoked, or is
+	// unusable.
+	DKIMPermError DKIMStatus = "permerror"
+)
+
+// DKIMResult is the result of verifying one DKIM-Signature field.
+type DKIMResult struct {
+	Status DKIMStatus
+
+	// Domain, Selector, and Identifier are the signature's d=, s=, and i=
+	// tags, if it could be parsed that far.
+	Domain     string
+	Selector   string
+	Identifier string
+
+	// Err describes why the signature did not pass. It is nil for DKIMPass.
+	Err error
+}
+
+// TXTResolver looks up DNS TXT records. A *net.Resolver is a TXTResolver;
+// tests may use an in-memory implementation.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// ErrNoRawMessage is returned when verifying an Email that does not hold the
+// data it was parsed from.
+var ErrNoRawMessage = errors.New("email: no raw message to verify")
+
+// DKIMVerifier verifies DKIM signatures, as described in RFC 6376.
+type DKIMVerifier struct {
+	// Resolver is used to look up public keys. If nil, net.DefaultResolver
+	// is used.
+	Resolver TXTResolver
+
+	// Now, if non-nil, is used in place of time.Now to check whether
+	// signatures have expired.
+	Now func() time.Time
+}
+
+// VerifyEmail verifies the DKIM signatures of e, which must have been parsed
+// and still hold its original data in e.Root.Raw.
+func (v *DKIMVerifier) VerifyEmail(ctx context.Context, e *Email) ([]DKIMResult, error) {
+	if e.Root == nil || e.Root.Raw == nil {
+		return nil, ErrNoRawMessage
+	}
+	return v.Verify(ctx, e.Root.Raw), nil
+}
+
+// Verify verifies every DKIM-Signature field in the message raw and returns
+// their results in the order the fields appear. A message without signatures
+// has no results.
+func (v *DKIMVerifier) Verify(ctx context.Context, raw []byte) []DKIMResult {
+	hdr, body := splitHeader(toCRLF(raw))
+	fields := splitFields(hdr)
+	var results []DKIMResult
+	for _, f := range fields {
+		if strings.EqualFold(fieldName(f), dkimSignature) {
+			results = append(results, v.verify(ctx, f, fields, body))
+		}
+	}
+	return results
+}
+
+// verify verifies the DKIM-Signature field sig of the message with the given
+// header fields and body.
+func (v *DKIMVerifier) verify(ctx context.Context, sig []byte, fields [][]byte, body []byte) DKIMResult {
+	var res DKIMResult
+	fail := func(status DKIMStatus, format string, args ...interface{}) DKIMResult {
+		res.Status = status
+		res.Err = fmt.Errorf("email: DKIM: "+format, args...)
+		return res
+	}
+
+	tags, err := parseTags(fieldValue(sig))
+	if err != nil {
+		return fail(DKIMNeutral, "%v", err)
+	}
+	res.Domain, res.Selector, res.Identifier = tags["d"], tags["s"], tags["i"]
+	if tags["v"] != "1" {
+		return fail(DKIMNeutral, "unsupported version %q", tags["v"])
+	}
+	signsFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		signsFrom = signsFrom || strings.EqualFold(strings.TrimSpace(name), from)
+	}
+	if !signsFrom {
+		return fail(DKIMNeutral, "From is not signed")
+	}
+	if id := res.Identifier; id != "" {
+		i := strings.LastIndexByte(id, '@')
+		if i < 0 || !isSubdomain(id[i+1:], res.Domain) {
+			return fail(DKIMNeutral, "i= is not within d=")
+		}
+	}
+	if q, ok := tags["q"]; ok && !strings.HasPrefix(q, "dns/txt") {
+		return fail(DKIMNeutral, "unsupported query method %q", q)
+	}
+	if x, ok := tags["x"]; ok {
+		exp, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fail(DKIMNeutral, "malformed x= tag")
+		}
+		if v.now().Unix() > exp {
+			return fail(DKIMFail, "signature expired")
+		}
+	}
+	if status, err := v.checkSignature(ctx, sig, tags, fields, body); err != nil {
+		return fail(status, "%v", err)
+	}
+	res.Status = DKIMPass
+	return res
+}
+
+func (v *DKIMVerifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// checkSignature verifies the signature in the field sig, whose tags have been
+// parsed, over the message with the given header fields and body. This is the
+// part of verification that DKIM-Signature and ARC-Message-Signature fields
+// share. On failure, it returns the status to report.
+func (v *DKIMVerifier) checkSignature(ctx context.Context, sig []byte, tags map[string]string, fields [][]byte, body []byte) (DKIMStatus, error) {
+	for _, t := range [...]string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return DKIMNeutral, fmt.Errorf("missing %s= tag", t)
+		}
+	}
+	hc, bc, err := parseCanonicalization(tags["c"])
+	if err != nil {
+		return DKIMNeutral, err
+	}
+	names := strings.Split(tags["h"], ":")
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+	}
+	bh, err := base64.StdEncoding.DecodeString(stripWSP(tags["bh"]))
+	if err != nil {
+		return DKIMNeutral, errors.New("malformed bh= tag")
+	}
+
+	cbody := canonicalBody(body, bc)
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n < 0 {
+			return DKIMNeutral, errors.New("malformed l= tag")
+		}
+		if n > int64(len(cbody)) {
+			return DKIMFail, fmt.Errorf("body is shorter than l=%d", n)
+		}
+		cbody = cbody[:n]
+	}
+	if sum := sha256.Sum256(cbody); !bytes.Equal(sum[:], bh) {
+		return DKIMFail, errors.New("body hash did not verify")
+	}
+
+	h := sha256.New()
+	for _, f := range selectFields(fields, names) {
+		h.Write(canonicalHeader(f, hc))
+	}
+	return v.checkDigest(ctx, sig, tags, h, hc)
+}
+
+// checkDigest completes h, the hash of the signed header fields, with the
+// field sig minus its b= value and checks the signature in its b= tag.
+func (v *DKIMVerifier) checkDigest(ctx context.Context, sig []byte, tags map[string]string, h hash.Hash, c Canonicalization) (DKIMStatus, error) {
+	algo := tags["a"]
+	if algo != "rsa-sha256" && algo != "ed25519-sha256" {
+		return DKIMNeutral, fmt.Errorf("unsupported algorithm %q", algo)
+	}
+	b, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return DKIMNeutral, errors.New("malformed b= tag")
+	}
+	key, status, err := v.lookupKey(ctx, tags["s"], tags["d"], algo)
+	if err != nil {
+		return status, err
+	}
+	if id := tags["i"]; key.strict && strings.Contains(id, "@") && !strings.EqualFold(id[strings.LastIndexByte(id, '@')+1:], tags["d"]) {
+		return DKIMPermError, errors.New("key requires i= to match d=")
+	}
+	h.Write(bytes.TrimSuffix(canonicalHeader(removeTagValue(sig, "b"), c), []byte(lineEnding)))
+	if err := key.verify(h.Sum(nil), b); err != nil {
+		return DKIMFail, errors.New("signature did not verify")
+	}
+	return "", nil
+}
+
+// dkimKey is a public key published in DNS.
+type dkimKey struct {
+	pub    crypto.PublicKey
+	strict bool // t=s: i= must not be a subdomain of d=
+}
+
+// verify verifies sig over digest, a SHA-256 hash.
+func (k *dkimKey) verify(digest, sig []byte) error {
+	switch pub := k.pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, sig) {
+			return errors.New("email: invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return errDKIMKey
+}
+
+// lookupKey retrieves the public key for selector and domain, which must be
+// suitable for algo. On error, the status is DKIMTempError or DKIMPermError.
+func (v *DKIMVerifier) lookupKey(ctx context.Context, selector, domain, algo string) (*dkimKey, DKIMStatus, error) {
+	r := v.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	txts, err := r.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, DKIMPermError, fmt.Errorf("no key for %s._domainkey.%s", selector, domain)
+		}
+		return nil, DKIMTempError, err
+	}
+	if len(txts) == 0 {
+		return nil, DKIMPermError, fmt.Errorf("no key for %s._domainkey.%s", selector, domain)
+	}
+
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, DKIMPermError, fmt.Errorf("malformed key record: %v", err)
+	}
+	if ver, ok := tags["v"]; ok && ver != "DKIM1" {
+		return nil, DKIMPermError, fmt.Errorf("unsupported key version %q", ver)
+	}
+	if hs, ok := tags["h"]; ok && !containsTag(hs, "sha256") {
+		return nil, DKIMPermError, errors.New("key does not allow sha256")
+	}
+	if s, ok := tags["s"]; ok && !containsTag(s, "*") && !containsTag(s, "email") {
+		return nil, DKIMPermError, errors.New("key is not for email")
+	}
+	p := stripWSP(tags["p"])
+	if p == "" {
+		return nil, DKIMPermError, errors.New("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, DKIMPermError, errors.New("malformed key")
+	}
+
+	k := &dkimKey{strict: containsTag(tags["t"], "s")}
+	kt := tags["k"]
+	if kt == "" {
+		kt = "rsa"
+	}
+	switch {
+	case kt == "rsa" && algo == "rsa-sha256":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// Some publish a bare PKCS #1 RSAPublicKey.
+			if pub, err = x509.ParsePKCS1PublicKey(der); err != nil {
+				return nil, DKIMPermError, errors.New("malformed RSA key")
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, DKIMPermError, errors.New("malformed RSA key")
+		}
+		if rsaPub.N.BitLen() < 1024 {
+			return nil, DKIMPermError, errors.New("RSA key shorter than 1024 bits")
+		}
+		k.pub = rsaPub
+	case kt == "ed25519" && algo == "ed25519-sha256":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, DKIMPermError, errors.New("malformed Ed25519 key")
+		}
+		k.pub = ed25519.PublicKey(der)
+	default:
+		return nil, DKIMPermError, fmt.Errorf("key type %q does not match algorithm %q", kt, algo)
+	}
+	return k, "", nil
+}
+
+// parseTags parses a DKIM tag list, as described in RFC 6376, section 3.2.
+func parseTags(s string) (map[string]string, error) {
+	s = strings.NewReplacer("\r\n", "", "\n", "").Replace(s)
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed tag %q", strings.TrimSpace(spec))
+		}
+		name := strings.TrimSpace(spec[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(spec[i+1:])
+	}
+	return tags, nil
+}
+
+// parseCanonicalization parses a c= tag. The body algorithm defaults to
+// simple, as does the whole tag.
+func parseCanonicalization(c string) (header, body Canonicalization, err error) {
+	header, body = CanonSimple, CanonSimple
+	if c == "" {
+		return header, body, nil
+	}
+	h, b := c, ""
+	if i := strings.IndexByte(c, '/'); i >= 0 {
+		h, b = c[:i], c[i+1:]
+	}
+	header = Canonicalization(h)
+	if b != "" {
+		body = Canonicalization(b)
+	}
+	for _, x := range [...]Canonicalization{header, body} {
+		if x != CanonSimple && x != CanonRelaxed {
+			return "", "", fmt.Errorf("unsupported canonicalization %q", c)
+		}
+	}
+	return header, body, nil
+}
+
+// fieldValue returns the value of the header field f, after the colon.
+func fieldValue(f []byte) string {
+	if i := bytes.IndexByte(f, ':'); i >= 0 {
+		return string(f[i+1:])
+	}
+	return ""
+}
+
+// removeTagValue returns the header field f with the value of the tag name
+// removed, leaving "name=".
+func removeTagValue(f []byte, name string) []byte {
+	i := bytes.IndexByte(f, ':') + 1
+	for i > 0 && i < len(f) {
+		end := bytes.IndexByte(f[i:], ';')
+		if end < 0 {
+			end = len(f)
+		} else {
+			end += i
+		}
+		spec := f[i:end]
+		if eq := bytes.IndexByte(spec, '='); eq >= 0 && string(bytes.TrimSpace(spec[:eq])) == name {
+			// Keep the trailing line break of the field, if the tag is last.
+			valEnd := end
+			if end == len(f) {
+				valEnd = len(bytes.TrimRight(f, "\r\n"))
+			}
+			out := append([]byte(nil), f[:i+eq+1]...)
+			return append(out, f[valEnd:]...)
+		}
+		i = end + 1
+	}
+	return f
+}
+
+// toCRLF converts bare LF line endings in msg to CRLF.
+func toCRLF(msg []byte) []byte {
+	if bytes.Count(msg, []byte("\n")) == bytes.Count(msg, []byte(lineEnding)) {
+		return msg
+	}
+	msg = bytes.Replace(msg, []byte(lineEnding), []byte("\n"), -1)
+	return bytes.Replace(msg, []byte("\n"), []byte(lineEnding), -1)
+}
+
+// stripWSP removes all whitespace from s.
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// containsTag reports whether the colon-separated list s contains v.
+func containsTag(s, v string) bool {
+	for _, x := range strings.Split(s, ":") {
+		if strings.TrimSpace(x) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubdomain reports whether domain is parent or one of its subdomains.
+func isSubdomain(domain, parent string) bool {
+	domain, parent = strings.ToLower(domain), strings.ToLower(parent)
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
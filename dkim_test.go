@@ -0,0 +1,332 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc8463Body is the body of the example message in RFC 8463, appendix A.
+const rfc8463Body = "Hi.\r\n\r\nWe lost the game.  Are you hungry yet?\r\n\r\nJoe.\r\n"
+
+func TestCanonicalBody(t *testing.T) {
+	tests := []struct {
+		body string
+		c    Canonicalization
+		want string
+	}{
+		{"", CanonSimple, "\r\n"},
+		{"", CanonRelaxed, ""},
+		{"\r\n\r\n", CanonRelaxed, ""},
+		{"a \t b \r\n\r\n\r\n", CanonSimple, "a \t b \r\n"},
+		{"a \t b \r\n\r\n\r\n", CanonRelaxed, "a b\r\n"},
+		{"no newline", CanonRelaxed, "no newline\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(canonicalBody([]byte(tt.body), tt.c)); got != tt.want {
+			t.Errorf("canonicalBody(%q, %s) = %q, want %q", tt.body, tt.c, got, tt.want)
+		}
+	}
+
+	// Body hashes from RFC 8463, appendix A.
+	bh := sha256.Sum256(canonicalBody([]byte(rfc8463Body), CanonRelaxed))
+	if got, want := base64.StdEncoding.EncodeToString(bh[:]), "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="; got != want {
+		t.Errorf("wrong relaxed body hash: %s, want %s", got, want)
+	}
+	bh = sha256.Sum256(canonicalBody([]byte(rfc8463Body), CanonSimple))
+	if got, want := base64.StdEncoding.EncodeToString(bh[:]), "4bLNXImK9drULnmePzZNEBleUanJCX5PIsDIFoH4KTQ="; got != want {
+		t.Errorf("wrong simple body hash: %s, want %s", got, want)
+	}
+}
+
+func TestCanonicalHeader(t *testing.T) {
+	const f = "SubJect :  AbC\r\n \t dEf  \r\n"
+	if got := string(canonicalHeader([]byte(f), CanonSimple)); got != f {
+		t.Errorf("simple: %q", got)
+	}
+	if got, want := string(canonicalHeader([]byte(f), CanonRelaxed)), "subject:AbC dEf\r\n"; got != want {
+		t.Errorf("relaxed: %q, want %q", got, want)
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	fields := splitFields([]byte("From: a\r\nTo: b\r\n c\r\nFrom: d\r\n\r\n"))
+	if len(fields) != 3 || string(fields[1]) != "To: b\r\n c\r\n" {
+		t.Fatalf("wrong fields: %q", fields)
+	}
+	got := selectFields(fields, []string{"from", "to", "from", "from"})
+	want := []string{"From: d\r\n", "To: b\r\n c\r\n", "From: a\r\n"}
+	if len(got) != len(want) {
+		t.Fatalf("wrong selection: %q", got)
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Errorf("#%d: %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+var dkimB = regexp.MustCompile(`(b=)[A-Za-z0-9+/=\r\n ]*$`)
+
+// checkDKIM verifies the first DKIM-Signature in msg, which must have been
+// made by s.
+func checkDKIM(t *testing.T, msg []byte, s *DKIMSigner) {
+	t.Helper()
+	hdr, body := splitHeader(msg)
+	fields := splitFields(hdr)
+	sigField := string(fields[0])
+	if fieldName(fields[0]) != dkimSignature {
+		t.Fatalf("first field is not a DKIM-Signature: %q", sigField)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(sigField, lineEnding), lineEnding) {
+		if len(line) > maxHeaderLine {
+			t.Errorf("line longer than %d characters: %q", maxHeaderLine, line)
+		}
+	}
+	b64 := strings.NewReplacer("\r\n", "", " ", "").Replace(dkimB.FindStringSubmatch(sigField)[0][2:])
+	sig, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := strings.TrimSuffix(dkimB.ReplaceAllString(sigField, "$1"), lineEnding)
+
+	hc, bc := s.HeaderCanonicalization, s.BodyCanonicalization
+	if hc == "" {
+		hc = CanonRelaxed
+	}
+	if bc == "" {
+		bc = CanonRelaxed
+	}
+	bh := sha256.Sum256(canonicalBody(body, bc))
+	if !strings.Contains(sigField, "bh="+base64.StdEncoding.EncodeToString(bh[:])) {
+		t.Errorf("wrong body hash in %q", sigField)
+	}
+	names := regexp.MustCompile(`h=([^;]*);`).FindStringSubmatch(sigField)[1]
+	h := sha256.New()
+	for _, f := range selectFields(fields[1:], strings.Split(names, ":")) {
+		h.Write(canonicalHeader(f, hc))
+	}
+	h.Write(bytes.TrimSuffix(canonicalHeader([]byte(unsigned), hc), []byte(lineEnding)))
+
+	switch pub := s.Key.Public().(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, h.Sum(nil), sig) {
+			t.Error("bad Ed25519 signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h.Sum(nil), sig); err != nil {
+			t.Errorf("bad RSA signature: %v", err)
+		}
+	}
+}
+
+func TestEncoder_DKIM(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers := []*DKIMSigner{
+		{Domain: "example.com", Selector: "ed", Key: edKey},
+		{Domain: "example.com", Selector: "rsa", Key: rsaKey},
+		{
+			Domain: "example.com", Selector: "simple", Key: edKey,
+			HeaderCanonicalization: CanonSimple,
+			BodyCanonicalization:   CanonSimple,
+			Headers:                []string{"From", "Subject", "Subject"},
+			BodyLength:             true,
+			Expiration:             time.Hour,
+		},
+	}
+	for _, s := range signers {
+		e := dummyEmail
+		e.Subject = strings.Repeat("A long subject that will be folded ", 4)
+		enc := testEncoder()
+		enc.DKIM = []*DKIMSigner{s}
+		var buf bytes.Buffer
+		if _, err := enc.Encode(&buf, &e); err != nil {
+			t.Fatalf("%s: %v", s.Selector, err)
+		}
+		checkDKIM(t, buf.Bytes(), s)
+	}
+
+	s := signers[2]
+	e := dummyEmail
+	enc := testEncoder()
+	enc.DKIM = []*DKIMSigner{s}
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, &e); err != nil {
+		t.Fatal(err)
+	}
+	now := enc.Now().Unix()
+	for _, tag := range []string{
+		"a=ed25519-sha256", "c=simple/simple", "d=example.com", "s=simple",
+		"h=From:Subject:Subject", "l=", "t=" + strconv.FormatInt(now, 10), "x=" + strconv.FormatInt(now+3600, 10),
+	} {
+		if !strings.Contains(buf.String(), tag) {
+			t.Errorf("signature has no %q tag:\n%s", tag, buf.Bytes())
+		}
+	}
+
+	enc.DKIM = []*DKIMSigner{{Domain: "example.com", Selector: "x", Key: edKey, Headers: []string{"To"}}}
+	if _, err := enc.Encode(&buf, &e); err != errDKIMNoFrom {
+		t.Errorf("expected errDKIMNoFrom, got %v", err)
+	}
+	enc.DKIM = []*DKIMSigner{{Domain: "example.com", Selector: "x"}}
+	if _, err := enc.Encode(&buf, &e); err != errDKIMKey {
+		t.Errorf("expected errDKIMKey, got %v", err)
+	}
+}
+
+// txtRecords is an in-memory TXTResolver.
+type txtRecords map[string][]string
+
+func (r txtRecords) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if name == "tempfail._domainkey.example.com" {
+		return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+	}
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+// rfc8463Message is the signed example message from RFC 8463, appendix A.
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=test; t=1528637909; h=from : to : subject :\r\n" +
+	" date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3\r\n" +
+	" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz\r\n" +
+	" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" + rfc8463Body
+
+var rfc8463Keys = txtRecords{
+	"brisbane._domainkey.football.example.com": {
+		"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	},
+	"test._domainkey.football.example.com": {
+		"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWR" +
+			"iGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutAC" +
+			"DfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3" +
+			"Ip3G+2kryOTIKT+l/K4w3QIDAQAB",
+	},
+}
+
+func TestDKIMVerifier_RFC8463(t *testing.T) {
+	v := DKIMVerifier{Resolver: rfc8463Keys}
+	results := v.Verify(context.Background(), []byte(rfc8463Message))
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.Status != DKIMPass {
+			t.Errorf("%s: %s: %v", r.Selector, r.Status, r.Err)
+		}
+	}
+}
+
+func TestDKIMVerifier(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := txtRecords{
+		"ed._domainkey.example.com":      {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+		"revoked._domainkey.example.com": {"v=DKIM1; k=ed25519; p="},
+	}
+	sign := func(s *DKIMSigner, e *Email) []byte {
+		t.Helper()
+		enc := testEncoder()
+		enc.DKIM = []*DKIMSigner{s}
+		var buf bytes.Buffer
+		if _, err := enc.Encode(&buf, e); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	signed := func(sel string) []byte {
+		e := dummyEmail
+		return sign(&DKIMSigner{Domain: "example.com", Selector: sel, Key: edKey, BodyLength: true, Expiration: time.Hour}, &e)
+	}
+	at := func(ts time.Time) func() time.Time { return func() time.Time { return ts } }
+	signedAt := testEncoder().Now()
+
+	tests := []struct {
+		name   string
+		msg    []byte
+		now    time.Time
+		status DKIMStatus
+	}{
+		{"pass", signed("ed"), signedAt, DKIMPass},
+		{"bare LF", bytes.Replace(signed("ed"), []byte("\r\n"), []byte("\n"), -1), signedAt, DKIMPass},
+		{"appended body", append(signed("ed"), "footer\r\n"...), signedAt, DKIMPass},
+		{"modified body", bytes.Replace(signed("ed"), []byte("Fancy"), []byte("Plain"), 1), signedAt, DKIMFail},
+		{"modified header", bytes.Replace(signed("ed"), []byte("Awesome"), []byte("Awful"), 1), signedAt, DKIMFail},
+		{"expired", signed("ed"), signedAt.Add(2 * time.Hour), DKIMFail},
+		{"no key", signed("missing"), signedAt, DKIMPermError},
+		{"revoked key", signed("revoked"), signedAt, DKIMPermError},
+		{"DNS failure", signed("tempfail"), signedAt, DKIMTempError},
+		{"malformed", bytes.Replace(signed("ed"), []byte("v=1"), []byte("v=2"), 1), signedAt, DKIMNeutral},
+	}
+	for _, tt := range tests {
+		v := DKIMVerifier{Resolver: keys, Now: at(tt.now)}
+		results := v.Verify(context.Background(), tt.msg)
+		if len(results) != 1 {
+			t.Fatalf("%s: expected 1 result, got %d", tt.name, len(results))
+		}
+		r := results[0]
+		if r.Status != tt.status {
+			t.Errorf("%s: status %s (%v), want %s", tt.name, r.Status, r.Err, tt.status)
+		}
+		if (r.Err == nil) != (r.Status == DKIMPass) {
+			t.Errorf("%s: status %s with error %v", tt.name, r.Status, r.Err)
+		}
+	}
+
+	// Verifying a parsed message uses the data it was parsed from.
+	e, err := New(bytes.NewReader(signed("ed")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := DKIMVerifier{Resolver: keys, Now: at(signedAt)}
+	results, err := v.VerifyEmail(context.Background(), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != DKIMPass || results[0].Domain != "example.com" {
+		t.Errorf("wrong results for parsed message: %+v", results)
+	}
+	if _, err := v.VerifyEmail(context.Background(), &dummyEmail); err != ErrNoRawMessage {
+		t.Errorf("expected ErrNoRawMessage, got %v", err)
+	}
+}
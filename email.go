@@ -3,21 +3,24 @@
 package email
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/http"
+	"net/mail"
 	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode"
 )
@@ -53,6 +56,44 @@ var ErrMissingBoundary = errors.New("email: no boundary found for multipart enti
 // a MIME entity
 var ErrMissingContentType = errors.New("email: no Content-Type found for MIME entity")
 
+// ErrMessageTooLarge is returned when an email being parsed is larger than the
+// allowed maximum size. The error returned is a *MessageTooLargeError, which
+// matches ErrMessageTooLarge with errors.Is.
+var ErrMessageTooLarge = errors.New("email: message too large")
+
+// MessageTooLargeError reports that an email being parsed was larger than
+// Limit bytes. Nothing parsed from such an email is returned, as it would be
+// incomplete.
+type MessageTooLargeError struct {
+	Limit int64
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("email: message larger than %d bytes", e.Limit)
+}
+
+// Is reports whether target is ErrMessageTooLarge.
+func (e *MessageTooLargeError) Is(target error) bool {
+	return target == ErrMessageTooLarge
+}
+
+// PartError reports a problem with a single part of a parsed email.
+type PartError struct {
+	Part *Part
+	Err  error
+}
+
+func (e *PartError) Error() string {
+	if name := e.Part.Filename(); name != "" {
+		return fmt.Sprintf("email: %s part %q: %v", e.Part.MediaType, name, e.Err)
+	}
+	return fmt.Sprintf("email: %s part: %v", e.Part.MediaType, e.Err)
+}
+
+func (e *PartError) Unwrap() error {
+	return e.Err
+}
+
 // Email represents an RFC 5322 email.
 type Email struct {
 	From        string
@@ -64,35 +105,138 @@ type Email struct {
 	HTML        []byte
 	Headers     textproto.MIMEHeader
 	Attachments []Attachment
+
+	// TextCharset and HTMLCharset name the character sets of Text and HTML.
+	// If empty, UTF-8 is assumed.
+	TextCharset string
+	HTMLCharset string
+
+	// Root is the MIME structure of the message body. If set by the caller,
+	// it is written in place of Text, HTML, and Attachments. Parsed Emails
+	// have Root set to their original structure for inspection, but are
+	// written from the other fields, so that changes to them take effect,
+	// unless parsed with Parser.KeepBody.
+	Root *Part
+
+	// parsed is the Root the Email was parsed into, which is not written.
+	parsed *Part
+
+	// DecodeErrors lists the parts of a parsed Email whose bodies could not
+	// be decoded, each as a *PartError. Such a body is kept as it was
+	// transmitted, still in its Content-Transfer-Encoding.
+	DecodeErrors []error
+
+	// order lists header field names as they were spelled, one entry per
+	// value, in the order they were parsed or added with AddHeader and
+	// SetHeader.
+	order []string
 }
 
-// trimReader is a custom io.Reader that will trim any leading whitespace, as
-// this can cause email imports to fail.
-type trimReader struct {
-	rd io.Reader
+// AddHeader adds the header field key: value to e.Headers. Custom fields added
+// with AddHeader or SetHeader are written in the order they were added, after
+// the standard fields; other custom fields follow them in sorted order.
+func (e *Email) AddHeader(key, value string) {
+	if e.Headers == nil {
+		e.Headers = make(textproto.MIMEHeader)
+	}
+	e.Headers.Add(key, value)
+	e.order = append(e.order, key)
 }
 
-// Read trims off any unicode whitespace from the originating reader
-func (tr trimReader) Read(buf []byte) (int, error) {
-	n, err := tr.rd.Read(buf)
-	// TODO: get rid of double copy
-	t := bytes.TrimLeftFunc(buf[:n], unicode.IsSpace)
-	n = copy(buf, t)
-	return n, err
+// SetHeader sets the header field key to value in e.Headers, replacing any
+// existing values. See AddHeader.
+func (e *Email) SetHeader(key, value string) {
+	canon := textproto.CanonicalMIMEHeaderKey(key)
+	if e.Headers != nil {
+		delete(e.Headers, canon)
+	}
+	order := e.order[:0:0]
+	for _, f := range e.order {
+		if textproto.CanonicalMIMEHeaderKey(f) != canon {
+			order = append(order, f)
+		}
+	}
+	e.order = order
+	e.AddHeader(key, value)
+}
+
+// Parser holds options for constructing Emails from RFC 5322 data. The zero
+// value is ready to use and behaves like New.
+type Parser struct {
+	// MaxSize is the largest email that will be read. If zero,
+	// DefaultEmailSize is used.
+	MaxSize int64
+
+	// CharsetReader, if non-nil, is used to convert text bodies in character
+	// sets this package does not support natively to UTF-8, such as EUC-KR
+	// or Big5. It has the same contract as mime.WordDecoder's CharsetReader.
+	//
+	// Supported natively are ISO-8859-1, -2, -5, -7, -9, and -15, Windows
+	// code pages 1250 to 1252, KOI8-R and KOI8-U, ISO-2022-JP, Shift_JIS,
+	// EUC-JP, and GB 2312.
+	CharsetReader func(charset string, input io.Reader) (io.Reader, error)
+
+	// RawCharset, if true, leaves Text and HTML in their original character
+	// sets. Email.TextCharset and Email.HTMLCharset report what they are.
+	RawCharset bool
+
+	// KeepBody, if true, makes parsed Emails write their original body,
+	// from Email.Root, rather than one built from Text, HTML, and
+	// Attachments. Changes to those fields are then ignored when writing.
+	KeepBody bool
 }
 
 // NewWithSize constructs an Email from an io.Reader in the same manner as New,
 // except it allows the maximum size to be specified.
 func NewWithSize(r io.Reader, maxSize int64) (*Email, error) {
-	s := trimReader{rd: io.LimitReader(r, maxSize)}
-	tp := textproto.NewReader(bufio.NewReader(s))
+	p := Parser{MaxSize: maxSize}
+	return p.Parse(r)
+}
+
+// Parse constructs an Email from an io.Reader. The data is expected to be in
+// RFC 5322 format.
+//
+// Text and HTML bodies are converted to UTF-8 unless p.RawCharset is set. A
+// body whose character set cannot be converted is left as is, and its
+// character set is reported in Email.TextCharset or Email.HTMLCharset. Parts
+// whose Content-Transfer-Encoding cannot be undone are kept as they are and
+// reported in Email.DecodeErrors.
+//
+// If the data is larger than p.MaxSize, a *MessageTooLargeError is returned.
+func (p *Parser) Parse(r io.Reader) (*Email, error) {
+	maxSize := p.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultEmailSize
+	}
+	lr := &limitReader{r: r, n: maxSize}
+	raw, err := ioutil.ReadAll(lr)
+	if lr.exceeded {
+		return nil, &MessageTooLargeError{Limit: maxSize}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Leading whitespace can cause email imports to fail.
+	return p.parse(bytes.TrimLeftFunc(raw, unicode.IsSpace))
+}
 
-	// Parse the main headers
-	hdrs, err := tp.ReadMIMEHeader()
+func (p *Parser) parse(raw []byte) (*Email, error) {
+	root, err := parsePart(raw)
 	if err != nil {
 		return nil, err
 	}
 
+	// The message headers stay with the Email; the Content- fields, which
+	// describe the body, are also kept with Root.
+	hdrs := root.Header
+	p.decodeHeaders(hdrs)
+	root.Header = make(textproto.MIMEHeader)
+	for k, v := range hdrs {
+		if strings.HasPrefix(k, "Content-") {
+			root.Header[k] = v
+		}
+	}
+
 	e := Email{
 		Subject: hdrs.Get(subject),
 		To:      hdrs[to],
@@ -100,23 +244,35 @@ func NewWithSize(r io.Reader, maxSize int64) (*Email, error) {
 		BCC:     hdrs[bcc],
 		From:    hdrs.Get(from),
 		Headers: hdrs,
+		Root:    root,
+		order:   headerFields(raw),
+	}
+	if !p.KeepBody {
+		e.parsed = root
 	}
 
 	for _, hv := range [...]string{subject, to, cc, bcc} {
 		delete(hdrs, hv)
 	}
 
-	// Recursively parse the MIME parts
-	ps, err := parseMIMEParts(e.Headers, tp.R)
-	if err != nil {
-		return nil, err
-	}
-	for _, p := range ps {
-		switch p.ctyp {
+	dec := p.wordDecoder()
+	for _, pt := range root.leaves() {
+		body, err := pt.Decoded()
+		if err != nil {
+			// One corrupt part does not make the rest of the message
+			// unreadable.
+			e.DecodeErrors = append(e.DecodeErrors, &PartError{Part: pt, Err: err})
+			body = pt.Body
+		}
+		if pt.isAttachment() {
+			e.Attachments = append(e.Attachments, pt.attachment(body, dec))
+			continue
+		}
+		switch pt.MediaType {
 		case "text/plain":
-			e.Text = p.body
+			e.Text, e.TextCharset = p.decodeCharset(body, pt.Params["charset"])
 		case "text/html":
-			e.HTML = p.body
+			e.HTML, e.HTMLCharset = p.decodeCharset(body, pt.Params["charset"])
 		}
 	}
 	return &e, nil
@@ -125,6 +281,35 @@ func NewWithSize(r io.Reader, maxSize int64) (*Email, error) {
 // DefaultEmailSize is the largest email allowed to be read from NewFromReader.
 const DefaultEmailSize = 1 << 20 // 1 MB
 
+// limitReader is like io.LimitedReader, but records whether the underlying
+// reader had more than n bytes.
+type limitReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := io.ReadFull(l.r, b[:])
+		if n > 0 {
+			l.exceeded = true
+			return 0, ErrMessageTooLarge
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
 // New constructs an Email from an io.Reader. The data is expected to be in
 // RFC 5322 format.
 func New(r io.Reader) (*Email, error) {
@@ -141,107 +326,126 @@ func (e *Email) Close() error {
 	return nil
 }
 
-// part is a copyable representation of a multipart.Part
-type part struct {
-	ctyp string
-	body []byte
-}
-
-func parseMediaType(p textproto.MIMEHeader) (mtype, boundary string, err error) {
+func parseMediaType(p textproto.MIMEHeader) (mtype string, params map[string]string, err error) {
 	if _, ok := p[contentType]; !ok {
 		p.Set(contentType, defaultContentType)
 	}
-	mtyp, params, err := mime.ParseMediaType(p.Get(contentType))
-	if err != nil {
-		return "", "", err
+	return mime.ParseMediaType(p.Get(contentType))
+}
+
+// decodeTransfer returns a reader that undoes the Content-Transfer-Encoding
+// given in p. Identity encodings (7bit, 8bit, binary) and encodings that are
+// not understood are returned as is.
+func decodeTransfer(p textproto.MIMEHeader, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(p.Get(contentXferEncoding))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
 	}
-	return mtyp, params["boundary"], nil
 }
 
-func parseMultipart(r io.Reader, boundary string) (ps []part, err error) {
-	if boundary == "" {
-		return nil, ErrMissingBoundary
+// Attach attaches an io.ReadCloser to the email, using the provided name and
+// content type. If ctype == "", the content type is determined from the
+// filename's extension or, if the io.ReadCloser implements io.Seeker, sniffed.
+// Otherwise, "application/octet-stream" will be used.
+func (e *Email) Attach(rc io.ReadCloser, filename, ctype string) error {
+	a, err := newAttachment(rc, filename, ctype, "attachment")
+	if err != nil {
+		return err
 	}
-	mr := multipart.NewReader(r, boundary)
-	for {
-		p, err := mr.NextPart()
-		if err != nil {
-			if err == io.EOF {
-				return ps, nil
-			}
-			return nil, err
-		}
-		pp, err := parseMIMEParts(p.Header, p)
-		if err != nil {
-			return nil, err
-		}
-		ps = append(ps, pp...)
+	e.Attachments = append(e.Attachments, a)
+	return nil
+}
+
+// AttachFile attaches a file from disk. Its content type is automatically
+// detected.
+func (e *Email) AttachFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
 	}
+	return e.Attach(file, filepath.Base(filename), "")
 }
 
-func parseMIMEParts(p textproto.MIMEHeader, r io.Reader) (ps []part, err error) {
-	mtyp, bdy, err := parseMediaType(p)
+// Embed attaches an io.ReadCloser to the email as an inline part, such as an
+// image, to be referenced from the HTML body. It returns the "cid:" URL by
+// which the HTML refers to it, e.g. in <img src="cid:...">. The content type
+// is determined as in Attach.
+//
+// Inline parts are grouped with the HTML body in a multipart/related entity,
+// which mail clients require to render them.
+func (e *Email) Embed(rc io.ReadCloser, filename, ctype string) (string, error) {
+	a, err := newAttachment(rc, filename, ctype, "inline")
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	id, err := newContentID()
+	if err != nil {
+		rc.Close()
+		return "", err
+	}
+	a.Header.Set(contentID, "<"+id+">")
+	e.Attachments = append(e.Attachments, a)
+	return "cid:" + id, nil
+}
 
-	if strings.HasPrefix(mtyp, "multipart/") {
-		sps, err := parseMultipart(r, bdy)
-		if err != nil {
-			return nil, err
-		}
-		ps = append(ps, sps...)
-	} else {
-		var buf bytes.Buffer
-		if _, err := io.Copy(&buf, r); err != nil {
-			return nil, err
-		}
-		ps = []part{{body: buf.Bytes(), ctyp: mtyp}}
+// EmbedFile embeds a file from disk as with Embed. Its content type is
+// automatically detected.
+func (e *Email) EmbedFile(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
 	}
-	return ps, nil
+	return e.Embed(file, filepath.Base(filename), "")
 }
 
-// Attach attaches an io.ReadCloser to the email, using the provided name and
-// content type. If contentType == "" and the io.ReadCloser implements
-// io.Seeker, the content type will be sniffed. Otherwise,
-// "application/octet-stream" will be used.
-func (e *Email) Attach(rc io.ReadCloser, filename, contentType string) (err error) {
-	if contentType == "" {
+// newAttachment creates an Attachment with the given Content-Disposition type,
+// determining its content type if ctype is empty. rc is closed on error.
+func newAttachment(rc io.ReadCloser, filename, ctype, dispo string) (a Attachment, err error) {
+	if err := checkField(contentType, ctype); err != nil {
+		rc.Close()
+		return a, err
+	}
+	if ctype == "" {
 		if rs, ok := rc.(io.ReadSeeker); ok {
-			if contentType, err = sniffType(filename, rs); err != nil {
+			if ctype, err = sniffType(filename, rs); err != nil {
 				rc.Close()
-				return err
+				return a, err
 			}
-		} else {
-			contentType = "application/octet-stream"
+		} else if ctype = mime.TypeByExtension(filepath.Ext(filename)); ctype == "" {
+			ctype = "application/octet-stream"
+		}
+	}
+
+	// Clients that predate RFC 2231 look for the name in Content-Type.
+	if len(filename) > maxParamSegment || !isPrintableASCII(filename) {
+		if _, params, err := mime.ParseMediaType(ctype); err == nil && params["name"] == "" {
+			ctype += ";" + lineEnding + " name=" + legacyParam(filename)
 		}
 	}
 
-	e.Attachments = append(e.Attachments, Attachment{
+	return Attachment{
 		Name: filename,
 		Header: textproto.MIMEHeader{
-			contentDispo: []string{
-				fmt.Sprintf(`attachment;\r\n filename="%s"`, filename),
-			},
-			contentID: []string{
-				fmt.Sprintf("<%s>", filename),
-			},
+			contentDispo:        []string{formatDisposition(dispo, filename)},
 			contentXferEncoding: []string{"base64"},
-			contentType:         []string{contentType},
+			contentType:         []string{ctype},
 		},
 		Body: rc,
-	})
-	return nil
+	}, nil
 }
 
-// AttachFile attaches a file from disk. Its content type is automatically
-// detected.
-func (e *Email) AttachFile(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
+// newContentID returns a globally unique Content-ID, without angle brackets,
+// as described in RFC 2392.
+func newContentID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
 	}
-	return e.Attach(file, filename, "")
+	return fmt.Sprintf("%x@%s", b, hostname), nil
 }
 
 func sniffType(name string, rs io.ReadSeeker) (string, error) {
@@ -265,14 +469,18 @@ func sniffType(name string, rs io.ReadSeeker) (string, error) {
 // message. It does not alter e.Headers.
 //
 // "e"'s fields To, Cc, From, Subject will be used unless they are present in
-// e.Headers. Unless set in e.Headers, date will filled with the current time.
-func (e *Email) msgHeaders() (textproto.MIMEHeader, error) {
-	res := make(textproto.MIMEHeader, len(e.Headers))
-	if e.Headers != nil {
+// e.Headers. Unless set in e.Headers, date will filled with the current time
+// and the Message-Id generated, as enc specifies.
+func (e *Email) msgHeaders(enc *Encoder) (textproto.MIMEHeader, error) {
+	headers := canonicalKeys(e.Headers)
+	res := make(textproto.MIMEHeader, len(headers))
+	if headers != nil {
 		for _, h := range [...]string{
 			to, cc, from, subject, date, msgID,
 		} {
-			res[h] = e.Headers[h]
+			if v, ok := headers[h]; ok {
+				res[h] = v
+			}
 		}
 	}
 
@@ -288,22 +496,22 @@ func (e *Email) msgHeaders() (textproto.MIMEHeader, error) {
 	// From, Return-Path, and Date are required headers.
 	if _, ok := res[from]; !ok {
 		if e.From == "" {
-			return nil, errors.New("email: 'From' field cannot be empty")
+			return nil, ErrNoFrom
 		}
 		res.Set(from, e.From)
 	}
 
-	now := time.Now()
+	now := enc.now()
 	if _, ok := res[date]; !ok {
 		res.Set(date, now.Format(time.RFC1123Z))
 	}
 	if _, ok := res[msgID]; !ok {
-		res.Set(msgID, e.messageID(now))
+		res.Set(msgID, enc.messageID(e))
 	}
 	if _, ok := res[mimeVers]; !ok {
 		res.Set(mimeVers, "1.0")
 	}
-	for field, vals := range e.Headers {
+	for field, vals := range headers {
 		if _, ok := res[field]; !ok {
 			res[field] = vals
 		}
@@ -337,100 +545,274 @@ func (c *countWriter) Write(p []byte) (n int, err error) {
 }
 
 func (c *countWriter) WriteString(p string) (n int, err error) {
-	return io.WriteString(c.w, p)
+	n, err = io.WriteString(c.w, p)
+	c.n += int64(n)
+	return n, err
 }
 
 // WriteTo writes a serialized Email to w. It implements io.WriterTo.
 func (e *Email) WriteTo(w io.Writer) (int64, error) {
+	var enc Encoder
+	return enc.Encode(w, e)
+}
+
+// Encoder holds options for serializing Emails. The zero value is ready to
+// use and behaves like Email.WriteTo.
+//
+// Header fields are always written in the same order, so setting Now,
+// Boundary, and MessageID to deterministic functions makes the output
+// reproducible byte for byte, e.g. for golden-file tests.
+type Encoder struct {
+	// SMTPUTF8, if true, writes non-ASCII header text as raw UTF-8, as
+	// permitted by RFC 6532, instead of as RFC 2047 encoded-words. It must
+	// only be set if the message will be relayed with the SMTPUTF8
+	// extension. Addresses with non-ASCII characters cannot be written
+	// without it.
+	SMTPUTF8 bool
+
+	// Now, if non-nil, is used in place of time.Now for the Date header of
+	// Emails that do not have one.
+	Now func() time.Time
+
+	// Boundary, if non-nil, is used to generate boundaries for multipart
+	// entities that do not have one. The boundaries must not occur in the
+	// entities' contents.
+	Boundary func() string
+
+	// MessageID is used to generate the Message-Id of Emails that do not
+	// have one. If nil, RandomMessageID("") is used.
+	MessageID MessageIDGenerator
+
+	// PreserveHeaderOrder, if true, writes header fields in the order they
+	// were parsed or added instead of in the canonical order. This keeps
+	// parsed messages that are written again as close to the original as
+	// possible. Fields with no recorded position follow in canonical order.
+	PreserveHeaderOrder bool
+
+	// DKIM lists signers whose DKIM-Signature fields are added to the top of
+	// the message. The message is buffered in memory to be signed.
+	DKIM []*DKIMSigner
+
+	// SMIME, if set, signs and/or encrypts the body of messages with
+	// S/MIME.
+	SMIME *SMIME
+
+	// PGP, if set, signs and/or encrypts the body of messages with
+	// PGP/MIME. It cannot be used together with SMIME.
+	PGP *PGP
+
+	// ARC, if set, adds an ARC set above any DKIM-Signature fields,
+	// continuing the chain of parsed Emails that have one. Like DKIM, the
+	// message is buffered in memory to be sealed. Validating the chain
+	// looks up keys in DNS; Transports bound this with the context they
+	// are given, as does EncodeContext.
+	ARC *ARCSealer
+}
+
+// Encode writes a serialized Email to w.
+func (enc *Encoder) Encode(w io.Writer, e *Email) (int64, error) {
+	return enc.EncodeContext(context.Background(), w, e)
+}
+
+// EncodeContext is like Encode, but ctx bounds the DNS lookups made to
+// validate the existing ARC chain of a message being sealed.
+func (enc *Encoder) EncodeContext(ctx context.Context, w io.Writer, e *Email) (int64, error) {
 	cw := countWriter{w: w}
-	err := e.writeTo(&cw)
+	err := enc.encode(ctx, &cw, e)
 	return cw.n, err
 }
 
-func (e *Email) writeTo(w io.Writer) error {
-	hdrs, err := e.msgHeaders()
+func (enc *Encoder) encode(ctx context.Context, w io.Writer, e *Email) error {
+	if len(enc.DKIM) > 0 || enc.ARC != nil {
+		return enc.encodeSigned(ctx, w, e)
+	}
+	hdrs, err := e.msgHeaders(enc)
 	if err != nil {
 		return err
 	}
 
-	mw := multipart.NewWriter(w)
-
-	// TODO: determine the content type based on message/attachment mix.
-	hdrs.Set(
-		contentType,
-		fmt.Sprintf("multipart/mixed;\r\n boundary=%s", mw.Boundary()),
-	)
-	writeHeader(w, hdrs)
-	io.WriteString(w, lineEnding)
-
-	// Start the multipart/mixed part
-	fmt.Fprintf(w, "--%s\r\n", mw.Boundary())
-	header := make(textproto.MIMEHeader)
-
-	// Check to see if there is a Text or HTML field
-	if len(e.Text) > 0 || len(e.HTML) > 0 {
-		sw := multipart.NewWriter(w)
-
-		// Create the multipart alternative part
-		header.Set(contentType,
-			fmt.Sprintf(
-				"multipart/alternative;\r\n boundary=%s\r\n",
-				sw.Boundary(),
-			),
-		)
-		// Write the header
-		writeHeader(w, header)
-
-		writeBody := func(content []byte, ctype string) error {
-			if len(content) == 0 {
-				return nil
-			}
-			header.Set(contentType, ctype)
-			header.Set(contentXferEncoding, "quoted-printable")
-			if _, err := sw.CreatePart(header); err != nil {
-				return err
+	root := e.Root
+	if !e.writesRoot() {
+		root = e.body()
+		// The content fields of a parsed message describe its original
+		// body, not this one.
+		if e.parsed != nil {
+			for k := range e.parsed.Header {
+				delete(hdrs, k)
 			}
-			qp := quotedprintable.NewWriter(w)
-			if _, err := qp.Write(content); err != nil {
-				return err
+		}
+	}
+	if enc.SMIME != nil || enc.PGP != nil {
+		switch {
+		case enc.PGP == nil:
+			root, err = enc.SMIME.wrap(root, enc)
+		case enc.SMIME == nil:
+			root, err = enc.PGP.wrap(root, enc)
+		default:
+			err = errSMIMEAndPGP
+		}
+		if err != nil {
+			return err
+		}
+		// The content header fields of the original body now belong to
+		// the signed or encrypted entity.
+		for k := range hdrs {
+			if strings.HasPrefix(k, "Content-") {
+				delete(hdrs, k)
 			}
-			return qp.Close()
 		}
+	}
+	for k, v := range root.header(enc) {
+		hdrs[k] = v
+	}
+	var preserved []string
+	if enc.PreserveHeaderOrder {
+		preserved = e.order
+	}
+	order := fieldOrder(hdrs, preserved, e.order)
+	if err := writeHeader(w, hdrs, order, enc.SMTPUTF8); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, lineEnding); err != nil {
+		return err
+	}
+	return root.writeBody(w, enc)
+}
 
-		writeBody(e.Text, "text/plain; charset=UTF-8")
-		writeBody(e.HTML, "text/html; charset=UTF-8")
-
-		if err := sw.Close(); err != nil {
+// encodeSigned writes e to w with a DKIM-Signature field from each of
+// enc.DKIM and an ARC set from enc.ARC, which sign the message exactly as it
+// is written.
+func (enc *Encoder) encodeSigned(ctx context.Context, w io.Writer, e *Email) error {
+	unsigned := *enc
+	unsigned.DKIM, unsigned.ARC = nil, nil
+	var buf bytes.Buffer
+	if err := unsigned.encode(ctx, &buf, e); err != nil {
+		return err
+	}
+	now := enc.now()
+	var sigs []byte
+	for _, s := range enc.DKIM {
+		sig, err := s.sign(buf.Bytes(), now)
+		if err != nil {
 			return err
 		}
+		sigs = append(sigs, sig...)
 	}
+	if enc.ARC != nil {
+		var orig []byte
+		if e.Root != nil {
+			orig = e.Root.Raw
+		}
+		set, err := enc.ARC.seal(ctx, append(sigs, buf.Bytes()...), orig, now)
+		if err != nil {
+			return err
+		}
+		sigs = append([]byte(set), sigs...)
+	}
+	if _, err := w.Write(sigs); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
 
-	if len(e.Attachments) > 0 {
-		var (
-			cw  chunkWriter
-			enc = base64.NewEncoder(base64.StdEncoding, &cw)
-		)
+func (enc *Encoder) now() time.Time {
+	if enc.Now != nil {
+		return enc.Now()
+	}
+	return time.Now()
+}
 
-		// Create attachment part, if necessary
-		for _, a := range e.Attachments {
-			part, err := mw.CreatePart(a.Header)
-			if err != nil {
-				return err
-			}
-			cw.w = part
-			if _, err := io.Copy(enc, a.Body); err != nil {
-				return err
-			}
+func (enc *Encoder) boundary() string {
+	if enc.Boundary != nil {
+		return enc.Boundary()
+	}
+	return multipart.NewWriter(nil).Boundary()
+}
+
+func (enc *Encoder) messageID(e *Email) string {
+	if enc.MessageID != nil {
+		return enc.MessageID(e)
+	}
+	return RandomMessageID("")(e)
+}
+
+// writesRoot reports whether e's body is written from e.Root rather than built
+// from its other fields.
+func (e *Email) writesRoot() bool {
+	return e.Root != nil && e.Root != e.parsed
+}
+
+// body builds the simplest MIME structure that holds e's Text, HTML, and
+// Attachments: a single text part, multipart/alternative for text and HTML,
+// multipart/related around the HTML part if there are inline parts, and
+// multipart/mixed only if there are regular attachments.
+func (e *Email) body() *Part {
+	var text, html *Part
+	if len(e.Text) > 0 {
+		text = NewPart("text/plain", textParams(e.TextCharset), e.Text)
+	}
+	if len(e.HTML) > 0 {
+		html = NewPart("text/html", textParams(e.HTMLCharset), e.HTML)
+	}
+
+	var inline, attached []*Part
+	for _, a := range e.Attachments {
+		if a.inline() {
+			inline = append(inline, a.part())
+		} else {
+			attached = append(attached, a.part())
+		}
+	}
+	// Inline parts are referenced from the HTML body, so they go in a
+	// multipart/related with it, within any multipart/alternative.
+	if len(inline) > 0 {
+		if html != nil {
+			html = related(html, inline)
+		} else {
+			text = related(text, inline)
 		}
+	}
 
-		if err := enc.Close(); err != nil {
-			return err
+	var alts []*Part
+	for _, p := range [...]*Part{text, html} {
+		if p != nil {
+			alts = append(alts, p)
 		}
-		if err := cw.Close(); err != nil {
-			return err
+	}
+	var content *Part
+	switch len(alts) {
+	case 0:
+		if len(e.Attachments) == 0 {
+			content = NewPart("text/plain", textParams(e.TextCharset), nil)
 		}
+	case 1:
+		content = alts[0]
+	default:
+		content = NewMultipart("multipart/alternative", alts...)
+	}
+	if len(attached) == 0 {
+		return content
 	}
-	return mw.Close()
+
+	mixed := NewMultipart("multipart/mixed")
+	if content != nil {
+		mixed.Parts = append(mixed.Parts, content)
+	}
+	mixed.Parts = append(mixed.Parts, attached...)
+	return mixed
+}
+
+// related returns a multipart/related part holding root, if non-nil, and the
+// parts it refers to.
+func related(root *Part, parts []*Part) *Part {
+	r := NewMultipart("multipart/related")
+	if root != nil {
+		r.Parts = append(r.Parts, root)
+		r.Params["type"] = root.MediaType
+	}
+	r.Parts = append(r.Parts, parts...)
+	return r
 }
 
 var errClosed = errors.New("email: chunkWriter is closed")
@@ -489,22 +871,56 @@ type Attachment struct {
 	Body   io.ReadCloser        // attachment itself
 }
 
-// writeHeader writes the a header. If there are multiple values for a field,
-// multiple "Field: value\r\n" lines will be emitted.
-func writeHeader(w io.Writer, header textproto.MIMEHeader) {
-	for field, vals := range header {
-		for _, subval := range vals {
-			io.WriteString(w, field)
-			io.WriteString(w, ": ")
-			switch field {
-			case contentType, contentDispo:
-				io.WriteString(w, subval)
-			default:
-				io.WriteString(w, mime.QEncoding.Encode("UTF-8", subval))
+// inline reports whether a is an inline part referenced by Content-ID, such as
+// one added with Embed, rather than a regular attachment.
+func (a Attachment) inline() bool {
+	if a.Header.Get(contentID) == "" {
+		return false
+	}
+	dispo, _, err := mime.ParseMediaType(a.Header.Get(contentDispo))
+	return err != nil || dispo == "inline"
+}
+
+// part returns a Part that streams a's body as base64. Attachments are always
+// written as base64, whatever encoding a parsed attachment originally used.
+func (a Attachment) part() *Part {
+	header := make(textproto.MIMEHeader, len(a.Header))
+	for k, v := range a.Header {
+		header[k] = v
+	}
+	header.Set(contentXferEncoding, "base64")
+	return &Part{Header: header, src: a.Body}
+}
+
+// writeHeader writes the header. If there are multiple values for a field,
+// multiple "Field: value\r\n" lines will be emitted. Fields are written in
+// the given order, as returned by fieldOrder, and spelled as they are there.
+// Non-ASCII text is encoded as described in RFC 2047 unless smtputf8 is set;
+// in address fields, only display names are encoded. Long lines are folded.
+// A field that could inject others is not written, and a *HeaderError is
+// returned.
+func writeHeader(w io.Writer, header textproto.MIMEHeader, order []string, smtputf8 bool) error {
+	next := make(map[string]int, len(header))
+	for _, name := range order {
+		field := textproto.CanonicalMIMEHeaderKey(name)
+		subval := header[field][next[field]]
+		next[field]++
+		if err := checkField(name, subval); err != nil {
+			return err
+		}
+		switch field {
+		case contentType, contentDispo:
+		default:
+			var err error
+			if subval, err = encodeField(field, subval, smtputf8); err != nil {
+				return err
 			}
-			io.WriteString(w, lineEnding)
+		}
+		if _, err := io.WriteString(w, foldHeader(name, subval)+lineEnding); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 var hostname = func() string {
@@ -515,17 +931,52 @@ var hostname = func() string {
 	return hostname
 }()
 
-func (e *Email) messageID(ts time.Time) string {
-	h := sha256.New()
+// MessageIDGenerator returns a Message-Id, including its angle brackets, for
+// an Email that does not have one.
+type MessageIDGenerator func(e *Email) string
+
+// RandomMessageID returns a MessageIDGenerator that makes IDs unique with 128
+// random bits, e.g. "<3f0c...@example.com>". The part after the "@" is
+// domain, which should be a domain the mail is sent from. If domain is empty,
+// the domain of the Email's From address is used or, failing that, the host
+// name. Should the system's random source fail, the time, process ID, and a
+// counter are used in place of the random bits.
+func RandomMessageID(domain string) MessageIDGenerator {
+	return func(e *Email) string {
+		d := domain
+		if d == "" {
+			d = fromDomain(e)
+		}
+		var b [16]byte
+		if _, err := io.ReadFull(randReader, b[:]); err != nil {
+			// Without random bits, the time, process, and a counter still
+			// make the ID unique to this host.
+			n := atomic.AddUint64(&idCounter, 1)
+			return fmt.Sprintf("<%x.%x.%x@%s>", time.Now().UnixNano(), os.Getpid(), n, d)
+		}
+		return fmt.Sprintf("<%x@%s>", b, d)
+	}
+}
+
+// randReader is the source of the random bits in Message-Ids.
+var randReader = rand.Reader
 
-	// h.Write does not return errors.
-	io.WriteString(h, e.From)
-	io.WriteString(h, e.Subject)
-	var buf [len(time.RFC3339)]byte
-	ts.Round(5*time.Minute).AppendFormat(buf[0:0], time.RFC3339)
-	h.Write(e.Text)
-	h.Write(e.HTML)
+// idCounter is incremented for each Message-Id made without random bits.
+var idCounter uint64
 
-	var hash [sha256.Size]byte
-	return fmt.Sprintf("<%x@%s>", h.Sum(hash[0:0])[4:20], hostname)
+// fromDomain returns the domain of e's From address, or the host name if
+// there is no usable one.
+func fromDomain(e *Email) string {
+	f := e.From
+	if v := e.Headers.Get(from); v != "" {
+		f = v
+	}
+	if a, err := mail.ParseAddress(f); err == nil {
+		if i := strings.LastIndexByte(a.Address, '@'); i >= 0 {
+			if d := a.Address[i+1:]; d != "" && isPrintableASCII(d) {
+				return d
+			}
+		}
+	}
+	return hostname
 }
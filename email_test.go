@@ -3,9 +3,14 @@ package email
 import (
 	"encoding"
 	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"bytes"
@@ -91,7 +96,7 @@ func TestEmail_Attach(t *testing.T) {
 	}
 	b := params["boundary"]
 	if b == "" {
-		t.Fatalf("Invalid or missing boundary parameter: ", b)
+		t.Fatalf("Invalid or missing boundary parameter: %q", b)
 	}
 	if len(params) != 1 {
 		t.Fatal("Unexpected content-type parameters")
@@ -128,7 +133,7 @@ func TestEmail_Attach(t *testing.T) {
 	// Check attachments.
 	_, err = mixed.NextPart()
 	if err != nil {
-		t.Fatalf("Could not find attachemnt compoenent of email: ", err)
+		t.Fatalf("Could not find attachemnt compoenent of email: %v", err)
 	}
 
 	if _, err = mixed.NextPart(); err != io.EOF {
@@ -228,7 +233,434 @@ This is a test message!`)
 	}
 }
 
-func Example_WriteTo() {
+func TestNew_TransferEncoding(t *testing.T) {
+	const raw = "From: foo@example.com\r\n" +
+		"To: bar@example.com\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: BASE64\r\n" +
+		"\r\n" +
+		"SGVsbG8sIHfDtnJsZCEKVGhpcyBpcyBiYXNlNjQuCg==\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"<p>H=C3=A9llo</p>\r\n" +
+		"--b--\r\n"
+
+	e, err := New(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Hello, w\u00f6rld!\nThis is base64.\n"; string(e.Text) != want {
+		t.Errorf("incorrect text:\nwant: %q\ngot : %q", want, e.Text)
+	}
+	if want := "<p>H=C3=A9llo</p>"; string(e.HTML) != want {
+		t.Errorf("8bit body should not be decoded:\nwant: %q\ngot : %q", want, e.HTML)
+	}
+}
+
+func TestNew_CorruptPart(t *testing.T) {
+	const raw = "From: foo@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=report.pdf\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0x!!!not base64\r\n" +
+		"--b--\r\n"
+
+	e, err := New(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Text) != "See attached." {
+		t.Errorf("incorrect text: %q", e.Text)
+	}
+	if len(e.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(e.Attachments))
+	}
+	body, err := ioutil.ReadAll(e.Attachments[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "JVBERi0x!!!not base64" {
+		t.Errorf("undecodable body not kept as is: %q", body)
+	}
+	if len(e.DecodeErrors) != 1 {
+		t.Fatalf("expected 1 decode error, got %v", e.DecodeErrors)
+	}
+	var pe *PartError
+	if !errors.As(e.DecodeErrors[0], &pe) || pe.Part.Filename() != "report.pdf" {
+		t.Errorf("wrong decode error: %v", e.DecodeErrors[0])
+	}
+	if msg := e.DecodeErrors[0].Error(); !strings.Contains(msg, `application/pdf part "report.pdf"`) {
+		t.Errorf("error %q does not name the part", msg)
+	}
+}
+
+func TestNew_RoundTrip(t *testing.T) {
+	e := dummyEmail
+	// Text bodies are written in canonical CRLF form.
+	e.Text = []byte("Gr\u00fc\u00dfe! = not an escape\r\n" +
+		strings.Repeat("A long line that must be soft-wrapped. ", 5) + "\r\n")
+	e.HTML = []byte("<p>caf\u00e9 \u2615</p>\r\n")
+
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Text, e.Text) {
+		t.Errorf("incorrect text:\nwant: %q\ngot : %q", e.Text, got.Text)
+	}
+	if !bytes.Equal(got.HTML, e.HTML) {
+		t.Errorf("incorrect HTML:\nwant: %q\ngot : %q", e.HTML, got.HTML)
+	}
+}
+
+func TestNew_Attachments(t *testing.T) {
+	e := dummyEmail
+	e.Attachments = nil
+	files := []struct {
+		name, ctype string
+		body        []byte
+	}{
+		{"notes.txt", "text/plain; charset=utf-8", []byte("plain text, but attached\n")},
+		{"blob.bin", "application/octet-stream", bytes.Repeat([]byte{0, 1, 2, 0xff}, 100)},
+	}
+	for _, f := range files {
+		rc := ioutil.NopCloser(bytes.NewReader(f.body))
+		if err := e.Attach(rc, f.name, f.ctype); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Text, []byte("Text Body is, of course, supported!\r\n")) {
+		t.Errorf("incorrect text: %q", got.Text)
+	}
+	if len(got.Attachments) != len(files) {
+		t.Fatalf("expected %d attachments, got %d", len(files), len(got.Attachments))
+	}
+	for i, f := range files {
+		a := got.Attachments[i]
+		if a.Name != f.name {
+			t.Errorf("#%d: wrong name: %q", i, a.Name)
+		}
+		if ct := a.Header.Get(contentType); ct != f.ctype {
+			t.Errorf("#%d: wrong Content-Type: %q", i, ct)
+		}
+		body, err := ioutil.ReadAll(a.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, f.body) {
+			t.Errorf("#%d: wrong body:\nwant: %q\ngot : %q", i, f.body, body)
+		}
+	}
+}
+
+func TestNew_AttachmentName(t *testing.T) {
+	const raw = "From: foo@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"%PDF=3D\r\n" +
+		"--b--\r\n"
+
+	e, err := New(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Text) != "See attached." {
+		t.Errorf("incorrect text: %q", e.Text)
+	}
+	if len(e.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(e.Attachments))
+	}
+	a := e.Attachments[0]
+	if a.Name != "report.pdf" {
+		t.Errorf("wrong name: %q", a.Name)
+	}
+	body, _ := ioutil.ReadAll(a.Body)
+	if string(body) != "%PDF=" {
+		t.Errorf("wrong body: %q", body)
+	}
+}
+
+func TestNewWithSize_TooLarge(t *testing.T) {
+	raw, err := dummyEmail.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(raw))
+
+	if _, err := NewWithSize(bytes.NewReader(raw), size); err != nil {
+		t.Fatalf("message of exactly the limit should parse: %v", err)
+	}
+
+	// Cutting anywhere, including in the multipart epilogue, is an error.
+	for _, limit := range []int64{10, size / 2, size - 1} {
+		_, err := NewWithSize(bytes.NewReader(raw), limit)
+		if !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("limit %d: expected ErrMessageTooLarge, got %v", limit, err)
+		}
+		var tle *MessageTooLargeError
+		if !errors.As(err, &tle) || tle.Limit != limit {
+			t.Fatalf("limit %d: expected *MessageTooLargeError, got %#v", limit, err)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// testEncoder returns an Encoder whose output is reproducible.
+func testEncoder() *Encoder {
+	n := 0
+	return &Encoder{
+		Now: func() time.Time { return time.Date(2020, time.May, 4, 12, 30, 0, 0, time.UTC) },
+		Boundary: func() string {
+			n++
+			return fmt.Sprintf("boundary-%d", n)
+		},
+		MessageID: func(*Email) string { return "<1@example.com>" },
+	}
+}
+
+func TestEncoder_Golden(t *testing.T) {
+	tests := []struct {
+		name string
+		mod  func(e *Email)
+	}{
+		{"text", func(e *Email) { e.HTML = nil }},
+		{"alternative", func(e *Email) {}},
+		{"mixed", func(e *Email) {
+			e.Attach(ioutil.NopCloser(strings.NewReader("attached")), "Überweisung.txt", "text/plain")
+		}},
+	}
+	for _, tt := range tests {
+		e := dummyEmail
+		e.Attachments = nil
+		tt.mod(&e)
+
+		var buf bytes.Buffer
+		if _, err := testEncoder().Encode(&buf, &e); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		file := filepath.Join("testdata", tt.name+".eml")
+		if *update {
+			if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s: output differs from %s:\n%s", tt.name, file, buf.Bytes())
+		}
+	}
+}
+
+func TestRandomMessageID(t *testing.T) {
+	e := dummyEmail
+	gen := RandomMessageID("")
+	id := gen(&e)
+	if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@gmail.com>") {
+		t.Errorf("wrong Message-Id: %q", id)
+	}
+	if id2 := gen(&e); id2 == id {
+		t.Errorf("identical emails got the same Message-Id: %q", id)
+	}
+	if _, err := mail.ParseAddress(strings.Trim(id, "<>")); err != nil {
+		t.Errorf("Message-Id is not a valid msg-id: %v", err)
+	}
+
+	if id := RandomMessageID("mail.example.org")(&e); !strings.HasSuffix(id, "@mail.example.org>") {
+		t.Errorf("domain not used: %q", id)
+	}
+	e.From = "not an address"
+	if id := gen(&e); !strings.HasSuffix(id, "@"+hostname+">") {
+		t.Errorf("host name not used: %q", id)
+	}
+
+	// A failing random source does not stop the email from being written.
+	randReader = iotest.ErrReader(errors.New("no entropy"))
+	id, id2 := gen(&e), gen(&e)
+	randReader = rand.Reader
+	if id == id2 {
+		t.Errorf("IDs made without random bits are not unique: %q", id)
+	}
+	if _, err := mail.ParseAddress(strings.Trim(id, "<>")); err != nil {
+		t.Errorf("Message-Id is not a valid msg-id: %v", err)
+	}
+
+	e = dummyEmail
+	enc := Encoder{MessageID: func(*Email) string { return "<fixed@example.com>" }}
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, &e); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Message-Id: <fixed@example.com>\r\n") {
+		t.Error("Encoder.MessageID not used")
+	}
+}
+
+func TestEmail_WriteToStructure(t *testing.T) {
+	attach := func(e *Email) {
+		e.Attach(ioutil.NopCloser(strings.NewReader("x")), "x.txt", "text/plain")
+	}
+	tests := []struct {
+		name   string
+		text   bool
+		html   bool
+		attach bool
+		want   string
+	}{
+		{"empty", false, false, false, "text/plain"},
+		{"text", true, false, false, "text/plain"},
+		{"html", false, true, false, "text/html"},
+		{"text+html", true, true, false, "multipart/alternative"},
+		{"attachment only", false, false, true, "multipart/mixed"},
+		{"text+attachment", true, false, true, "multipart/mixed"},
+	}
+	for _, tt := range tests {
+		e := Email{From: "foo@example.com", To: []string{"bar@example.com"}}
+		if tt.text {
+			e.Text = []byte("text")
+		}
+		if tt.html {
+			e.HTML = []byte("<p>html</p>")
+		}
+		if tt.attach {
+			attach(&e)
+		}
+		raw, err := e.MarshalText()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		mt, _, err := mime.ParseMediaType(msg.Header.Get(contentType))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if mt != tt.want {
+			t.Errorf("%s: top-level Content-Type is %q, want %q", tt.name, mt, tt.want)
+		}
+		if cte := msg.Header.Get(contentXferEncoding); !strings.HasPrefix(mt, "multipart/") && cte != "quoted-printable" {
+			t.Errorf("%s: single-part body has Content-Transfer-Encoding %q", tt.name, cte)
+		}
+	}
+}
+
+func TestEmail_Embed(t *testing.T) {
+	e := dummyEmail
+	e.Attachments = nil
+	cid, err := e.Embed(ioutil.NopCloser(strings.NewReader("\x89PNG")), "logo.png", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cid, "cid:") || !strings.Contains(cid, "@") {
+		t.Fatalf("invalid cid URL: %q", cid)
+	}
+	e.HTML = []byte(`<img src="` + cid + `">`)
+
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := got.Root
+	if root.MediaType != "multipart/alternative" || len(root.Parts) != 2 || root.Parts[0].MediaType != "text/plain" {
+		t.Fatalf("expected multipart/alternative with the text first, got %q %+v", root.MediaType, root.Parts)
+	}
+	rel := root.Parts[1]
+	if rel.MediaType != "multipart/related" || rel.Params["type"] != "text/html" {
+		t.Fatalf("expected multipart/related around the HTML, got %q %v", rel.MediaType, rel.Params)
+	}
+	if len(rel.Parts) != 2 || rel.Parts[0].MediaType != "text/html" {
+		t.Fatalf("unexpected related parts: %+v", rel.Parts)
+	}
+	img := rel.Parts[1]
+	if img.MediaType != "image/png" {
+		t.Errorf("wrong image type: %q", img.MediaType)
+	}
+	if id := img.Header.Get(contentID); id != "<"+strings.TrimPrefix(cid, "cid:")+">" {
+		t.Errorf("Content-ID %q does not match %q", id, cid)
+	}
+	if dispo := img.Header.Get(contentDispo); !strings.HasPrefix(dispo, "inline") {
+		t.Errorf("wrong disposition: %q", dispo)
+	}
+
+	// Content-IDs are unique.
+	cid2, err := e.Embed(ioutil.NopCloser(strings.NewReader("")), "logo.png", "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid2 == cid {
+		t.Error("Embed reused a Content-ID")
+	}
+
+	// Regular attachments go around the alternative.
+	e.Attach(ioutil.NopCloser(strings.NewReader("x")), "x.txt", "text/plain")
+	if raw, err = e.MarshalText(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = New(bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Root.MediaType != "multipart/mixed" || got.Root.Parts[0].MediaType != "multipart/alternative" {
+		t.Fatalf("unexpected structure: %q > %q", got.Root.MediaType, got.Root.Parts[0].MediaType)
+	}
+
+	// Without HTML, the text body holds the inline parts.
+	e.HTML = nil
+	if raw, err = e.MarshalText(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = New(bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if rel := got.Root.Parts[0]; rel.MediaType != "multipart/related" || rel.Params["type"] != "text/plain" {
+		t.Fatalf("unexpected structure: %q %v", rel.MediaType, rel.Params)
+	}
+}
+
+func ExampleEmail_WriteTo() {
 	e := Email{
 		From:    "John Smith <test@gmail.com>",
 		To:      []string{"test@example.com"},
@@ -246,7 +678,7 @@ func Example_WriteTo() {
 	}
 }
 
-func ExampleAttach() {
+func ExampleEmail_Attach() {
 	var e Email
 	e.AttachFile("test.txt")
 }
@@ -312,8 +744,9 @@ func Test_quotedPrintEncode(t *testing.T) {
 	}
 }
 
-func TestMultipartNoContentType(t *testing.T) {
-	raw := []byte(`From: Mikhail Gusarov <dottedmag@dottedmag.net>
+// pgpSignedMessage is a real PGP/MIME signed message, with the signature
+// shortened.
+var pgpSignedMessage = []byte(`From: Mikhail Gusarov <dottedmag@dottedmag.net>
 To: notmuch@notmuchmail.org
 References: <20091117190054.GU3165@dottiness.seas.harvard.edu>
 Date: Wed, 18 Nov 2009 01:02:38 +0600
@@ -352,6 +785,9 @@ Content-Disposition: inline
 Testing!
 --===============1958295626==--
 `)
+
+func TestMultipartNoContentType(t *testing.T) {
+	raw := pgpSignedMessage
 	e, err := New(bytes.NewReader(raw))
 	if err != nil {
 		t.Fatalf("Error when parsing email %s", err.Error())
@@ -412,13 +848,13 @@ func Benchmark_chunkWriter(b *testing.B) {
 
 var gid string
 
-func BenchmarkEmail_messageID(b *testing.B) {
+func BenchmarkRandomMessageID(b *testing.B) {
 	var (
 		lid string
-		now = time.Now()
+		gen = RandomMessageID("")
 	)
 	for i := 0; i < b.N; i++ {
-		lid = dummyEmail.messageID(now)
+		lid = gen(&dummyEmail)
 	}
 	gid = lid
 }
@@ -0,0 +1,154 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// imgSrc matches the src attribute of an <img> tag. The attribute value is in
+// whichever of the groups 2, 3, or 4 matched, depending on its quoting.
+var imgSrc = regexp.MustCompile(`(?is)(<img\b[^>]*?\bsrc\s*=\s*)(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// EmbedImages embeds the images referenced by <img> tags in e.HTML and
+// rewrites their src attributes to the resulting "cid:" URLs. Images given as
+// data: URIs are always embedded; images given as relative or absolute paths
+// are read from fsys, if it is non-nil. Other URLs, such as http: and cid:,
+// are left alone. Query strings and fragments of paths are ignored. An image
+// referenced more than once is embedded once.
+//
+// If an image cannot be embedded, EmbedImages returns the error and leaves e
+// unchanged.
+//
+// EmbedImages should be called after e.HTML is final and before the Email is
+// written.
+func (e *Email) EmbedImages(fsys fs.FS) error {
+	var (
+		cids     = make(map[string]string)
+		embedded Email // collects the images until all are embedded
+		err      error
+	)
+	html := imgSrc.ReplaceAllFunc(e.HTML, func(m []byte) []byte {
+		if err != nil {
+			return m
+		}
+		sm := imgSrc.FindSubmatch(m)
+		src, quote := string(sm[2]), `"`
+		switch {
+		case sm[3] != nil:
+			src, quote = string(sm[3]), `'`
+		case sm[4] != nil:
+			src = string(sm[4])
+		}
+
+		var cid string
+		if cid, err = embedded.embedSrc(src, fsys, cids); err != nil || cid == "" {
+			return m
+		}
+		return []byte(string(sm[1]) + quote + cid + quote)
+	})
+	if err != nil {
+		return err
+	}
+	e.HTML = html
+	e.Attachments = append(e.Attachments, embedded.Attachments...)
+	return nil
+}
+
+// embedSrc embeds the image referenced by src and returns its cid URL, or ""
+// if src does not refer to something that can be embedded. cids maps data URIs
+// and file names to the cid URLs they have already been embedded as.
+func (e *Email) embedSrc(src string, fsys fs.FS, cids map[string]string) (cid string, err error) {
+	if strings.HasPrefix(strings.ToLower(src), "data:") {
+		if cid, ok := cids[src]; ok {
+			return cid, nil
+		}
+		ctype, data, err := parseDataURI(src)
+		if err != nil {
+			return "", err
+		}
+		name := "image"
+		if exts, _ := mime.ExtensionsByType(ctype); len(exts) > 0 {
+			name += exts[0]
+		}
+		cid, err = e.Embed(readSeekNopCloser{bytes.NewReader(data)}, name, ctype)
+		cids[src] = cid
+		return cid, err
+	}
+
+	if fsys == nil {
+		return "", nil
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", nil
+	}
+	name := path.Clean(strings.TrimPrefix(u.Path, "/"))
+	if cid, ok := cids[name]; ok {
+		return cid, nil
+	}
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	cid, err = e.Embed(readSeekNopCloser{bytes.NewReader(data)}, path.Base(name), "")
+	cids[name] = cid
+	return cid, err
+}
+
+// readSeekNopCloser is ioutil.NopCloser for a *bytes.Reader, so that content
+// types can be sniffed and Validate can tell the size.
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+var errBadDataURI = errors.New("email: malformed data URI")
+
+// parseDataURI parses an RFC 2397 data URI.
+func parseDataURI(uri string) (ctype string, data []byte, err error) {
+	i := strings.IndexByte(uri, ',')
+	if i < 0 {
+		return "", nil, errBadDataURI
+	}
+	meta, payload := uri[len("data:"):i], uri[i+1:]
+
+	isBase64 := false
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		isBase64 = true
+		meta = meta[:len(meta)-len(";base64")]
+	}
+	ctype = "text/plain;charset=US-ASCII"
+	if meta != "" {
+		ctype = meta
+	}
+	if mt, _, err := mime.ParseMediaType(ctype); err == nil {
+		ctype = mt
+	}
+
+	payload, err = url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("email: malformed data URI: %v", err)
+	}
+	if !isBase64 {
+		return ctype, []byte(payload), nil
+	}
+	payload = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, payload)
+	if data, err = base64.StdEncoding.DecodeString(payload); err != nil {
+		return "", nil, fmt.Errorf("email: malformed data URI: %v", err)
+	}
+	return ctype, data, nil
+}
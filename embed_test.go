@@ -0,0 +1,103 @@
+package email
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmail_EmbedImages(t *testing.T) {
+	fsys := fstest.MapFS{
+		"img/logo.png":   {Data: []byte("\x89PNG\r\n\x1a\nlogo")},
+		"img/my pic.gif": {Data: []byte("GIF89a")},
+	}
+	e := dummyEmail
+	e.Attachments = nil
+	e.HTML = []byte(`<p><img src="img/logo.png" alt="logo">` +
+		`<IMG class=x SRC='/img/my%20pic.gif'>` +
+		`<img src=data:image/png;base64,iVBORw0K>` +
+		`<img src="./img/logo.png">` +
+		`<img src="img/logo.png?v=2#top">` +
+		`<img src="https://example.com/remote.png">` +
+		`<img src="cid:already@example.com"></p>`)
+
+	if err := e.EmbedImages(fsys); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.Attachments); n != 3 {
+		t.Fatalf("expected 3 embedded images, got %d", n)
+	}
+
+	cids := regexp.MustCompile(`cid:[^"' >]+`).FindAllString(string(e.HTML), -1)
+	if len(cids) != 6 {
+		t.Fatalf("expected 6 cid references, got %q in %s", cids, e.HTML)
+	}
+	if cids[0] != cids[3] || cids[0] != cids[4] {
+		t.Errorf("the same file was embedded twice: %q", cids)
+	}
+	if !bytes.Contains(e.HTML, []byte(`src="https://example.com/remote.png"`)) {
+		t.Errorf("remote image was rewritten: %s", e.HTML)
+	}
+
+	types := []string{"image/png", "image/gif", "image/png"}
+	for i, a := range e.Attachments {
+		if ct := a.Header.Get(contentType); ct != types[i] {
+			t.Errorf("#%d: wrong type %q, want %q", i, ct, types[i])
+		}
+		if id := "<" + strings.TrimPrefix(cids[i], "cid:") + ">"; a.Header.Get(contentID) != id {
+			t.Errorf("#%d: Content-ID %q does not match %q", i, a.Header.Get(contentID), id)
+		}
+	}
+	if e.Attachments[1].Name != "my pic.gif" {
+		t.Errorf("wrong name: %q", e.Attachments[1].Name)
+	}
+
+	if _, err := e.MarshalText(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmail_EmbedImagesMissing(t *testing.T) {
+	const html = `<img src="logo.png"><img src="missing.png">`
+	e := Email{HTML: []byte(html)}
+	fsys := fstest.MapFS{"logo.png": {Data: []byte("\x89PNG\r\n\x1a\nlogo")}}
+	if err := e.EmbedImages(fsys); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+	// The images before the missing one are not embedded either.
+	if string(e.HTML) != html || len(e.Attachments) != 0 {
+		t.Fatalf("email changed on error: %s %d", e.HTML, len(e.Attachments))
+	}
+
+	// Without a file system, paths are left alone.
+	if err := e.EmbedImages(nil); err != nil {
+		t.Fatal(err)
+	}
+	if string(e.HTML) != html || len(e.Attachments) != 0 {
+		t.Fatalf("unexpected result: %s %d", e.HTML, len(e.Attachments))
+	}
+}
+
+func TestParseDataURI(t *testing.T) {
+	tests := []struct {
+		uri, ctype, data string
+	}{
+		{"data:image/png;base64,aGVsbG8=", "image/png", "hello"},
+		{"data:,A%20brief%20note", "text/plain", "A brief note"},
+		{"data:image/svg+xml;charset=utf-8,%3Csvg%2F%3E", "image/svg+xml", "<svg/>"},
+	}
+	for _, tt := range tests {
+		ctype, data, err := parseDataURI(tt.uri)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.uri, err)
+		}
+		if ctype != tt.ctype || string(data) != tt.data {
+			t.Errorf("%s: got %q %q, want %q %q", tt.uri, ctype, data, tt.ctype, tt.data)
+		}
+	}
+	if _, _, err := parseDataURI("data:image/png;base64"); err == nil {
+		t.Error("expected an error for a data URI without data")
+	}
+}
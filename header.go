@@ -0,0 +1,560 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// addressHeaders are the headers whose values are address lists.
+var addressHeaders = [...]string{
+	from, to, cc, bcc, "Reply-To", "Sender",
+	"Resent-From", "Resent-To", "Resent-Cc", "Resent-Bcc", "Resent-Sender",
+}
+
+// unstructuredHeaders are the headers whose values are free text that may
+// contain RFC 2047 encoded-words.
+var unstructuredHeaders = [...]string{
+	subject, "Comments", "Keywords", "Content-Description", "Thread-Topic",
+}
+
+// traceHeaders are written first, in this order. See RFC 5322, section 3.6.
+var traceHeaders = [...]string{
+	"Return-Path", "Received",
+	"Resent-Date", "Resent-From", "Resent-Sender", "Resent-To", "Resent-Cc",
+	"Resent-Message-Id",
+}
+
+// leadingHeaders follow the trace headers, in this order.
+var leadingHeaders = [...]string{
+	from, "Sender", "Reply-To", to, cc, subject, date, msgID,
+}
+
+// contentHeaders, after Mime-Version, are written last, in this order.
+var contentHeaders = [...]string{
+	contentType, contentXferEncoding, contentDispo, contentID,
+}
+
+// fieldOrder returns the order in which to write the fields of h, with one
+// entry per value. Fields listed in preserved come first, in that order. The
+// rest are in canonical order: trace fields, the standard fields, custom
+// fields in the order listed in added and then sorted, and finally the MIME
+// fields. Names taken from preserved and added keep their spelling.
+func fieldOrder(h textproto.MIMEHeader, preserved, added []string) []string {
+	var (
+		order []string
+		left  = make(map[string]int, len(h))
+	)
+	for f, vals := range h {
+		left[f] = len(vals)
+	}
+	take := func(name string) {
+		if f := textproto.CanonicalMIMEHeaderKey(name); left[f] > 0 {
+			order = append(order, name)
+			left[f]--
+		}
+	}
+	takeAll := func(name string) {
+		for left[textproto.CanonicalMIMEHeaderKey(name)] > 0 {
+			take(name)
+		}
+	}
+	isMIME := func(name string) bool {
+		f := textproto.CanonicalMIMEHeaderKey(name)
+		return f == mimeVers || strings.HasPrefix(f, "Content-")
+	}
+
+	for _, f := range preserved {
+		take(f)
+	}
+	for _, f := range traceHeaders {
+		takeAll(f)
+	}
+	for _, f := range leadingHeaders {
+		takeAll(f)
+	}
+	for _, f := range added {
+		if !isMIME(f) {
+			takeAll(f)
+		}
+	}
+	var custom, content []string
+	for f, n := range left {
+		if n == 0 {
+			continue
+		}
+		if isMIME(f) {
+			content = append(content, f)
+		} else {
+			custom = append(custom, f)
+		}
+	}
+	sort.Strings(custom)
+	for _, f := range custom {
+		takeAll(f)
+	}
+	takeAll(mimeVers)
+	for _, f := range contentHeaders {
+		takeAll(f)
+	}
+	sort.Strings(content)
+	for _, f := range content {
+		takeAll(f)
+	}
+	return order
+}
+
+// canonicalKeys returns h keyed by canonical field names, as fieldOrder and
+// writeHeader look fields up. The values of keys that differ only in case are
+// merged. If h's keys are all canonical, h itself is returned.
+func canonicalKeys(h textproto.MIMEHeader) textproto.MIMEHeader {
+	keys := make([]string, 0, len(h))
+	canonical := true
+	for k := range h {
+		keys = append(keys, k)
+		canonical = canonical && k == textproto.CanonicalMIMEHeaderKey(k)
+	}
+	if canonical {
+		return h
+	}
+	sort.Strings(keys)
+	res := make(textproto.MIMEHeader, len(h))
+	for _, k := range keys {
+		f := textproto.CanonicalMIMEHeaderKey(k)
+		res[f] = append(res[f], h[k]...)
+	}
+	return res
+}
+
+// headerFields returns the names of the fields in the header of the raw
+// entity as they are spelled, in order, with one entry per occurrence.
+func headerFields(raw []byte) []string {
+	hdr, _ := splitHeader(raw)
+	var fields []string
+	for _, line := range strings.Split(string(hdr), "\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			fields = append(fields, strings.TrimSpace(line[:i]))
+		}
+	}
+	return fields
+}
+
+// wordDecoder returns a decoder for RFC 2047 encoded-words that supports the
+// same character sets as p does for bodies.
+func (p *Parser) wordDecoder() *mime.WordDecoder {
+	return &mime.WordDecoder{CharsetReader: p.charsetReader}
+}
+
+// decodeHeaders decodes the RFC 2047 encoded-words in h's unstructured headers
+// and in the display names of its address headers. Values that cannot be
+// decoded are left untouched.
+func (p *Parser) decodeHeaders(h textproto.MIMEHeader) {
+	dec := p.wordDecoder()
+	for _, field := range unstructuredHeaders {
+		for i, v := range h[field] {
+			if s, err := dec.DecodeHeader(v); err == nil {
+				h[field][i] = s
+			}
+		}
+	}
+	ap := mail.AddressParser{WordDecoder: dec}
+	for _, field := range addressHeaders {
+		for i, v := range h[field] {
+			if !strings.Contains(v, "=?") {
+				continue
+			}
+			if list, err := ap.ParseList(v); err == nil {
+				h[field][i] = formatAddressList(list)
+			} else if s, err := dec.DecodeHeader(v); err == nil {
+				h[field][i] = s
+			}
+		}
+	}
+}
+
+// ErrNonASCIIAddress is returned when writing an address with non-ASCII
+// characters, which can only be sent with the SMTPUTF8 extension, without
+// Encoder.SMTPUTF8 set or to a server that does not support it.
+var ErrNonASCIIAddress = errors.New("email: non-ASCII address requires SMTPUTF8")
+
+// HeaderError is returned when writing a header field whose name or value
+// contains characters that may not appear in it, such as a line break that
+// does not fold the field. Written as is, such a field could inject other
+// header fields or MIME parts into the message. Only line breaks followed by
+// whitespace, which fold the field, and tabs are allowed in values.
+type HeaderError struct {
+	Field string
+	Value string
+}
+
+func (e *HeaderError) Error() string {
+	if !validFieldName(e.Field) {
+		return fmt.Sprintf("email: invalid header field name %q", e.Field)
+	}
+	return fmt.Sprintf("email: invalid character in %s header field: %q", e.Field, e.Value)
+}
+
+// checkField returns a *HeaderError if name is not a valid field name or v
+// is not safe to write as its value.
+func checkField(name, v string) error {
+	if !validFieldName(name) || !validFieldValue(v) {
+		return &HeaderError{Field: name, Value: v}
+	}
+	return nil
+}
+
+// validFieldName reports whether name consists of printable ASCII other than
+// colon, as RFC 5322, section 3.6.8 requires.
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// validFieldValue reports whether v contains no control characters other
+// than tabs and CRLFs that fold the field. A fold must be followed by more
+// than whitespace, as some parsers take a blank line to end the header.
+func validFieldValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '\r':
+			if !strings.HasPrefix(v[i:], lineEnding+" ") && !strings.HasPrefix(v[i:], lineEnding+"\t") {
+				return false
+			}
+			i += len(lineEnding)
+			if rest := strings.TrimLeft(v[i:], " \t"); rest == "" || rest[0] == '\r' {
+				return false
+			}
+		case c == '\t':
+		case c < ' ' || c == 0x7f:
+			return false
+		}
+	}
+	return true
+}
+
+// encodeField encodes the value of a header field for writing. Address fields
+// are parsed so that only their display names are encoded; other fields are
+// treated as unstructured text. If smtputf8 is set, nothing is encoded.
+func encodeField(field, v string, smtputf8 bool) (string, error) {
+	for _, f := range addressHeaders {
+		if field == f {
+			return encodeAddressList(v, smtputf8)
+		}
+	}
+	return encodeText(v, smtputf8), nil
+}
+
+// encodeText encodes unstructured text as RFC 2047 encoded-words if it is not
+// ASCII and smtputf8 is not set.
+func encodeText(v string, smtputf8 bool) string {
+	if smtputf8 {
+		return v
+	}
+	return mime.QEncoding.Encode("UTF-8", v)
+}
+
+// encodeAddressList formats the address list v with each display name as a
+// phrase, encoded if necessary, and each addr-spec as is. A value that is not
+// a valid address list is encoded as unstructured text, as before.
+func encodeAddressList(v string, smtputf8 bool) (string, error) {
+	list, err := mail.ParseAddressList(v)
+	if err != nil {
+		return encodeText(v, smtputf8), nil
+	}
+	s := make([]string, len(list))
+	for i, a := range list {
+		if !smtputf8 && !isPrintableASCII(a.Address) {
+			return "", ErrNonASCIIAddress
+		}
+		s[i] = a.Address
+		if a.Name != "" {
+			s[i] = encodePhrase(a.Name, smtputf8) + " <" + a.Address + ">"
+		}
+	}
+	return strings.Join(s, ", "), nil
+}
+
+// encodePhrase returns name as an RFC 5322 phrase. Unless smtputf8 is set,
+// non-ASCII names are written as encoded-words, which in a phrase may only
+// contain letters, digits, and "!*+-/=_" (RFC 2047, section 5). Q encoding
+// is used where that allows, as it is easier to read, and B encoding
+// otherwise.
+func encodePhrase(name string, smtputf8 bool) string {
+	if smtputf8 || isPrintableASCII(name) {
+		return quotePhrase(name)
+	}
+	for _, r := range name {
+		if r < utf8.RuneSelf && !isAlnum(byte(r)) && !strings.ContainsRune(" !*+-/", r) {
+			return mime.BEncoding.Encode("UTF-8", name)
+		}
+	}
+	return mime.QEncoding.Encode("UTF-8", name)
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// maxHeaderLine is the line length, excluding CRLF, that header fields are
+// folded to where possible. See RFC 5322, section 2.1.1.
+const maxHeaderLine = 78
+
+// maxFieldLine is the longest line, excluding CRLF, RFC 5322 allows.
+const maxFieldLine = 998
+
+// foldHeader returns the header field "field: value", folded as described in
+// RFC 5322, section 2.2.3, so that its lines are no longer than maxHeaderLine
+// characters where the value has whitespace to fold at. In structured fields,
+// folding after a comma or semicolon is preferred. Line breaks already in
+// value are kept.
+func foldHeader(field, value string) string {
+	structured := true
+	for _, f := range unstructuredHeaders {
+		if textproto.CanonicalMIMEHeaderKey(field) == f {
+			structured = false
+		}
+	}
+	var b strings.Builder
+	b.WriteString(field + ":")
+	for i, line := range strings.Split(value, lineEnding) {
+		col := 0
+		if i == 0 {
+			line = " " + line
+			col = b.Len()
+		} else {
+			b.WriteString(lineEnding)
+		}
+		foldLine(&b, line, col, structured)
+	}
+	return b.String()
+}
+
+// foldLine writes s, which starts at column col, to b, inserting a line break
+// before whitespace wherever the line would otherwise be too long.
+func foldLine(b *strings.Builder, s string, col int, structured bool) {
+	for col+len(s) > maxHeaderLine {
+		// A line may not consist only of whitespace, so the break must come
+		// after some text, which may be the field name.
+		start := 0
+		if col == 0 {
+			start = len(s) - len(strings.TrimLeft(s, " \t")) + 1
+		}
+		brk, pref := -1, -1
+		for i := start; i < len(s); i++ {
+			if s[i] != ' ' && s[i] != '\t' {
+				continue
+			}
+			if col+i > maxHeaderLine && brk >= 0 {
+				break
+			}
+			brk = i
+			if structured && i > 0 && (s[i-1] == ',' || s[i-1] == ';') {
+				pref = i
+			}
+			if col+i > maxHeaderLine {
+				break // nothing fits; fold as soon as possible
+			}
+		}
+		if pref >= 0 {
+			brk = pref
+		}
+		if brk < 0 {
+			break
+		}
+		b.WriteString(s[:brk])
+		b.WriteString(lineEnding)
+		s, col = s[brk:], 0
+	}
+	b.WriteString(s)
+}
+
+// formatAddressList formats list as a comma-separated list of addresses. Unlike
+// mail.Address.String, display names are not encoded, only quoted if needed.
+func formatAddressList(list []*mail.Address) string {
+	s := make([]string, len(list))
+	for i, a := range list {
+		s[i] = formatAddress(a)
+	}
+	return strings.Join(s, ", ")
+}
+
+func formatAddress(a *mail.Address) string {
+	if a.Name == "" {
+		return a.Address
+	}
+	return quotePhrase(a.Name) + " <" + a.Address + ">"
+}
+
+// quotePhrase returns name as an RFC 5322 phrase, quoting it if it contains
+// characters other than atext and spaces. Non-ASCII characters are left as is.
+func quotePhrase(name string) string {
+	plain := true
+	for _, r := range name {
+		if !isAtext(r) && r != ' ' {
+			plain = false
+			break
+		}
+	}
+	if plain && strings.TrimSpace(name) == name {
+		return name
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range name {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isAtext reports whether r may appear in an RFC 5322 atom. Non-ASCII runes
+// are allowed, as in RFC 6532.
+func isAtext(r rune) bool {
+	switch {
+	case r >= 0x80:
+		return true
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+// maxParamSegment is the longest value segment, in bytes, written on one line
+// of a MIME parameter before RFC 2231 continuations are used.
+const maxParamSegment = 60
+
+// formatDisposition formats a Content-Disposition value of type dispo for a
+// file named filename. Names that are not short printable ASCII are encoded as
+// described in RFC 2231, split across continuation lines as needed.
+func formatDisposition(dispo, filename string) string {
+	return dispo + ";" + lineEnding + " " + formatParam("filename", filename)
+}
+
+// formatParam formats a MIME parameter. A value that is printable ASCII and
+// short enough is written as a quoted-string. Otherwise, it is percent-encoded
+// as UTF-8 per RFC 2231 and, if long, split into numbered continuations on
+// separate folded lines.
+func formatParam(key, value string) string {
+	if len(value) <= maxParamSegment && isPrintableASCII(value) {
+		return key + "=" + quoteParam(value)
+	}
+
+	var (
+		segs []string
+		seg  strings.Builder
+	)
+	seg.WriteString("UTF-8''")
+	for _, r := range value {
+		// Characters are not split across segments.
+		var tok string
+		if r < utf8.RuneSelf && isAttrChar(byte(r)) {
+			tok = string(r)
+		} else {
+			var buf [utf8.UTFMax]byte
+			for _, c := range buf[:utf8.EncodeRune(buf[:], r)] {
+				tok += fmt.Sprintf("%%%02X", c)
+			}
+		}
+		if seg.Len()+len(tok) > maxParamSegment {
+			segs = append(segs, seg.String())
+			seg.Reset()
+		}
+		seg.WriteString(tok)
+	}
+	segs = append(segs, seg.String())
+
+	if len(segs) == 1 {
+		return key + "*=" + segs[0]
+	}
+	for i, s := range segs {
+		segs[i] = fmt.Sprintf("%s*%d*=%s", key, i, s)
+	}
+	return strings.Join(segs, ";"+lineEnding+" ")
+}
+
+// legacyParam formats value as a quoted-string holding RFC 2047 encoded-words
+// if it needs encoding. This is not standard, but it is what many older
+// clients understand in place of RFC 2231.
+func legacyParam(value string) string {
+	if isPrintableASCII(value) {
+		return quoteParam(value)
+	}
+	words := mime.BEncoding.Encode("UTF-8", value)
+	if words == value {
+		// Only tabs needed encoding, which BEncoding leaves as they are.
+		return quoteParam(value)
+	}
+	// Whitespace between encoded-words is ignored, so they may be folded.
+	return `"` + strings.Replace(words, " ", lineEnding+" ", -1) + `"`
+}
+
+// quoteParam returns value as a MIME quoted-string.
+func quoteParam(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(value[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// isAttrChar reports whether c may appear unencoded in an RFC 2231 extended
+// parameter value.
+func isAttrChar(c byte) bool {
+	if c <= ' ' || c > '~' {
+		return false
+	}
+	return !strings.ContainsRune(`*'%()<>@,;:\"/[]?=`, rune(c))
+}
+
+// filename returns the file name given in a Content-Disposition or
+// Content-Type header, decoding RFC 2231 and, as many clients produce it,
+// RFC 2047 encoding.
+func filename(h textproto.MIMEHeader, dec *mime.WordDecoder) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(h.Get(contentDispo)); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(h.Get(contentType)); err == nil {
+			name = params["name"]
+		}
+	}
+	if strings.Contains(name, "=?") {
+		if s, err := dec.DecodeHeader(name); err == nil {
+			name = s
+		}
+	}
+	return name
+}
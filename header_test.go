@@ -0,0 +1,463 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParser_EncodedWords(t *testing.T) {
+	const raw = "From: =?UTF-8?Q?J=C3=B6rg_M=C3=BCller?= <j@example.com>\r\n" +
+		"To: =?ISO-8859-1?Q?M=FCller=2C_J=F6rg?= <j@example.com>, plain@example.com\r\n" +
+		"Cc: =?windows-1252?Q?=93Quoted=94?= <q@example.com>\r\n" +
+		"Subject: =?UTF-8?B?R3LDvMOfZQ==?= =?ISO-8859-1?Q?_aus_K=F6ln?=\r\n" +
+		"Comments: =?UTF-8?Q?caf=C3=A9?=\r\n" +
+		"Message-ID: <=?UTF-8?Q?not-decoded?=@example.com>\r\n" +
+		"\r\n" +
+		"body"
+
+	e, err := New(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Grüße aus Köln"; e.Subject != want {
+		t.Errorf("wrong subject: %q, want %q", e.Subject, want)
+	}
+	if want := "Jörg Müller <j@example.com>"; e.From != want {
+		t.Errorf("wrong From: %q, want %q", e.From, want)
+	}
+	if want := []string{`"Müller, Jörg" <j@example.com>, plain@example.com`}; !reflect.DeepEqual(e.To, want) {
+		t.Errorf("wrong To: %q, want %q", e.To, want)
+	}
+	if want := []string{"“Quoted” <q@example.com>"}; !reflect.DeepEqual(e.CC, want) {
+		t.Errorf("wrong Cc: %q, want %q", e.CC, want)
+	}
+	if want := "café"; e.Headers.Get("Comments") != want {
+		t.Errorf("wrong Comments: %q, want %q", e.Headers.Get("Comments"), want)
+	}
+	if want := "<=?UTF-8?Q?not-decoded?=@example.com>"; e.Headers.Get("Message-Id") != want {
+		t.Errorf("structured header was decoded: %q", e.Headers.Get("Message-Id"))
+	}
+
+	// The decoded addresses must still parse.
+	if _, err := e.Envelope(); err != nil {
+		t.Errorf("decoded addresses do not parse: %v", err)
+	}
+}
+
+func TestQuotePhrase(t *testing.T) {
+	tests := map[string]string{
+		"John Smith":     "John Smith",
+		"Jörg":           "Jörg",
+		"Smith, John":    `"Smith, John"`,
+		`The "Boss"`:     `"The \"Boss\""`,
+		" leading space": `" leading space"`,
+	}
+	for in, want := range tests {
+		if got := quotePhrase(in); got != want {
+			t.Errorf("quotePhrase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEncodeAddressList(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"j@example.com", "j@example.com"},
+		{"John Smith <j@example.com>", "John Smith <j@example.com>"},
+		{`"Smith, John" <j@example.com>`, `"Smith, John" <j@example.com>`},
+		{"Jörg Müller <j@example.com>", "=?UTF-8?q?J=C3=B6rg_M=C3=BCller?= <j@example.com>"},
+		{`"Müller, Jörg" <j@example.com>, a@example.com`, "=?UTF-8?b?TcO8bGxlciwgSsO2cmc=?= <j@example.com>, a@example.com"},
+		{"not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		got, err := encodeAddressList(tt.in, false)
+		if err != nil {
+			t.Errorf("encodeAddressList(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("encodeAddressList(%q):\nwant: %q\ngot : %q", tt.in, tt.want, got)
+		}
+	}
+
+	if _, err := encodeAddressList("用户@例子.广告", false); err != ErrNonASCIIAddress {
+		t.Errorf("expected ErrNonASCIIAddress, got %v", err)
+	}
+	if got, err := encodeAddressList("Jörg <用户@例子.广告>", true); err != nil || got != "Jörg <用户@例子.广告>" {
+		t.Errorf("SMTPUTF8: got %q, %v", got, err)
+	}
+}
+
+func TestEmail_WriteToAddresses(t *testing.T) {
+	e := Email{
+		From:    "Jörg Müller <j@example.com>",
+		To:      []string{`"Müller, Jörg" <m@example.com>`, "plain@example.com"},
+		Subject: "Grüße",
+	}
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if strings.HasPrefix(line, "From:") || strings.HasPrefix(line, "To:") {
+			if !isPrintableASCII(line) || strings.Contains(line, "example.com?=") {
+				t.Errorf("address not kept outside encoded-words: %q", line)
+			}
+		}
+	}
+
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.From != e.From {
+		t.Errorf("wrong From: %q", got.From)
+	}
+	if want := []string{`"Müller, Jörg" <m@example.com>, plain@example.com`}; !reflect.DeepEqual(got.To, want) {
+		t.Errorf("wrong To: %q, want %q", got.To, want)
+	}
+	if got.Subject != e.Subject {
+		t.Errorf("wrong Subject: %q", got.Subject)
+	}
+
+	enc := Encoder{SMTPUTF8: true}
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, &e); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"From: Jörg Müller <j@example.com>\r\n", "Subject: Grüße\r\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("SMTPUTF8 output does not contain %q", want)
+		}
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	tests := []struct {
+		field, value, want string
+	}{
+		{"Subject", "short", "Subject: short"},
+		{
+			"Subject",
+			strings.Repeat("word ", 20) + "end",
+			"Subject:" + strings.Repeat(" word", 14) + "\r\n" + strings.Repeat(" word", 6) + " end",
+		},
+		{
+			"To",
+			"Alice Example <alice@example.com>, Bob Example <bob@example.com>, carol@example.com",
+			"To: Alice Example <alice@example.com>, Bob Example <bob@example.com>,\r\n carol@example.com",
+		},
+		{
+			"To",
+			"Alice Example <alice@example.com>, Bob Example With A Very Long Name <bob@example.com>",
+			"To: Alice Example <alice@example.com>,\r\n Bob Example With A Very Long Name <bob@example.com>",
+		},
+		{
+			"Subject",
+			strings.Repeat("x", 100),
+			"Subject:\r\n " + strings.Repeat("x", 100),
+		},
+		{
+			contentDispo,
+			"attachment;\r\n filename=\"a.txt\"",
+			"Content-Disposition: attachment;\r\n filename=\"a.txt\"",
+		},
+	}
+	for _, tt := range tests {
+		if got := foldHeader(tt.field, tt.value); got != tt.want {
+			t.Errorf("foldHeader(%q, %q):\nwant: %q\ngot : %q", tt.field, tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestEmail_WriteToFolding(t *testing.T) {
+	e := Email{
+		From:    "sender@example.com",
+		Subject: strings.Repeat("Grüße aus Köln, ", 20),
+		Text:    []byte("hi"),
+	}
+	for i := 0; i < 200; i++ {
+		e.To = append(e.To, fmt.Sprintf("Recipient Number %d <r%d@example.com>", i, i))
+	}
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, _ := splitHeader(raw)
+	for _, line := range strings.Split(string(hdr), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("header line longer than 78 characters: %q", line)
+		}
+	}
+	for _, word := range strings.Fields(string(hdr)) {
+		if strings.HasPrefix(word, "=?") && len(word) > 75 {
+			t.Errorf("encoded-word longer than 75 characters: %q", word)
+		}
+	}
+
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != e.Subject {
+		t.Errorf("wrong Subject:\nwant: %q\ngot : %q", e.Subject, got.Subject)
+	}
+	env, err := got.Envelope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env.To) != len(e.To) || env.To[199] != "r199@example.com" {
+		t.Errorf("recipients lost in folding: %d", len(env.To))
+	}
+}
+
+func TestEncoder_HeaderOrder(t *testing.T) {
+	e := Email{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com"},
+		Subject: "order",
+		Headers: textproto.MIMEHeader{
+			"X-Zebra":  {"z"},
+			"Received": {"from a", "from b"},
+			"X-Apple":  {"a"},
+		},
+	}
+	e.AddHeader("x-mailer", "test")
+	e.AddHeader("List-Id", "<list.example.com>")
+	e.SetHeader("X-Mailer", "test 2")
+
+	var buf bytes.Buffer
+	if _, err := testEncoder().Encode(&buf, &e); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Received", "Received", "From", "To", "Subject", "Date", "Message-Id",
+		"List-Id", "X-Mailer", "X-Apple", "X-Zebra", "Mime-Version",
+		"Content-Type", "Content-Transfer-Encoding",
+	}
+	if got := headerFields(buf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong order:\nwant: %q\ngot : %q", want, got)
+	}
+	if !strings.HasPrefix(buf.String(), "Received: from a\r\nReceived: from b\r\n") {
+		t.Error("Received values reordered")
+	}
+	if e.Headers.Get("X-Mailer") != "test 2" {
+		t.Errorf("SetHeader did not replace: %q", e.Headers["X-Mailer"])
+	}
+}
+
+func TestEncoder_PreserveHeaderOrder(t *testing.T) {
+	const header = "Subject: hello\r\n" +
+		"X-First: 1\r\n" +
+		"From: sender@example.com\r\n" +
+		"DKIM-Signature: one\r\n" +
+		"To: rcpt@example.com\r\n" +
+		"DKIM-Signature: two\r\n" +
+		"Message-Id: <1@example.com>\r\n" +
+		"Date: Mon, 04 May 2020 12:30:00 +0000\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Mime-Version: 1.0\r\n" +
+		"\r\n"
+	const raw = header + "body\r\n"
+
+	p := Parser{KeepBody: true}
+	e, err := p.Parse(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := Encoder{PreserveHeaderOrder: true}
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, e); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != raw {
+		t.Errorf("message changed:\nwant: %q\ngot : %q", raw, buf.String())
+	}
+
+	buf.Reset()
+	if _, err := e.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "From: sender@example.com\r\nTo: rcpt@example.com\r\nSubject: hello\r\n") {
+		t.Errorf("not in canonical order:\n%s", buf.Bytes())
+	}
+}
+
+func TestEncoder_NonCanonicalHeaders(t *testing.T) {
+	raw := "From: sender@example.com\r\nTo: rcpt@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+	e, err := New(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Headers["x-mailer"] = []string{"foo"}
+	e.Headers["X-MAILER"] = []string{"bar"}
+	a := Attachment{Name: "a.txt", Header: textproto.MIMEHeader{"x-note": {"baz"}}, Body: ioutil.NopCloser(strings.NewReader("a"))}
+	e.Attachments = append(e.Attachments, a)
+
+	for _, preserve := range []bool{false, true} {
+		enc := testEncoder()
+		enc.PreserveHeaderOrder = preserve
+		var buf bytes.Buffer
+		if _, err := enc.Encode(&buf, e); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+		for _, want := range []string{"\r\nX-Mailer: bar\r\nX-Mailer: foo\r\n", "\r\nX-Note: baz\r\n"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("preserve %v: %q not written:\n%s", preserve, want, out)
+			}
+		}
+	}
+}
+
+func TestFormatParam(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"report.pdf", `filename="report.pdf"`},
+		{`say "hi".txt`, `filename="say \"hi\".txt"`},
+		{"Überweisung.pdf", `filename*=UTF-8''%C3%9Cberweisung.pdf`},
+		{"a\r\nb", `filename*=UTF-8''a%0D%0Ab`},
+		{
+			strings.Repeat("ü", 20) + ".txt",
+			"filename*0*=UTF-8''" + strings.Repeat("%C3%BC", 8) + ";\r\n" +
+				" filename*1*=" + strings.Repeat("%C3%BC", 10) + ";\r\n" +
+				" filename*2*=" + strings.Repeat("%C3%BC", 2) + ".txt",
+		},
+	}
+	for _, tt := range tests {
+		if got := formatParam("filename", tt.value); got != tt.want {
+			t.Errorf("formatParam(%q):\nwant: %q\ngot : %q", tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestAttachmentFilenames(t *testing.T) {
+	names := []string{
+		"plain.txt",
+		"Überweisung.pdf",
+		`quote"and\backslash.txt`,
+		"tab\tand\"quote\\.txt",
+		strings.Repeat("a very long file name ", 10) + "ünïcödé.txt",
+		"日本語のファイル名.txt",
+	}
+	e := dummyEmail
+	e.Attachments = nil
+	for _, name := range names {
+		if err := e.Attach(ioutil.NopCloser(strings.NewReader("x")), name, "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if strings.Contains(line, "filename") && len(line) > 78 {
+			t.Errorf("line longer than 78 characters: %q", line)
+		}
+	}
+
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Attachments) != len(names) {
+		t.Fatalf("expected %d attachments, got %d", len(names), len(got.Attachments))
+	}
+	for i, a := range got.Attachments {
+		if a.Name != names[i] {
+			t.Errorf("#%d: wrong name:\nwant: %q\ngot : %q", i, names[i], a.Name)
+		}
+	}
+
+	// The legacy Content-Type name decodes to the same thing.
+	h := textproto.MIMEHeader{}
+	h.Set(contentType, got.Attachments[1].Header.Get(contentType))
+	if name := filename(h, new(mime.WordDecoder)); name != names[1] {
+		t.Errorf("wrong legacy name: %q", name)
+	}
+}
+
+func TestPart_FilenameEncodedWord(t *testing.T) {
+	p := &Part{Header: textproto.MIMEHeader{}}
+	p.Header.Set(contentDispo, `attachment; filename="=?ISO-8859-1?Q?=DCberweisung.pdf?="`)
+	if name := p.Filename(); name != "Überweisung.pdf" {
+		t.Errorf("wrong name: %q", name)
+	}
+}
+
+func TestEmail_WriteToHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(e *Email)
+		field  string
+	}{
+		{"subject", func(e *Email) { e.Subject = "Hi\r\nBcc: victim@example.com" }, subject},
+		{"bare LF", func(e *Email) { e.Subject = "Hi\nBcc: victim@example.com" }, subject},
+		{"from", func(e *Email) { e.From = "Evil <evil@example.com>\r\nBcc: victim@example.com" }, from},
+		{"to", func(e *Email) { e.To = []string{"a@example.com\rBcc: victim@example.com"} }, to},
+		{"NUL", func(e *Email) { e.Subject = "Hi\x00" }, subject},
+		{"blank line", func(e *Email) { e.Subject = "Hi\r\n \r\n\r\n<html>" }, subject},
+		{"custom value", func(e *Email) { e.Headers = map[string][]string{"X-Tag": {"a\r\n\r\nbody"}} }, "X-Tag"},
+		{"custom name", func(e *Email) { e.Headers = map[string][]string{"X-Tag: a\r\nBcc": {"victim@example.com"}} }, "X-Tag: a\r\nBcc"},
+		{"empty name", func(e *Email) { e.Headers = map[string][]string{"": {"a"}} }, ""},
+		{"content type", func(e *Email) {
+			e.Attachments = []Attachment{{Header: textproto.MIMEHeader{contentType: {"text/plain\r\n\r\n--boundary"}}, Body: ioutil.NopCloser(strings.NewReader("x"))}}
+		}, contentType},
+	}
+	for _, tt := range tests {
+		for _, smtputf8 := range []bool{false, true} {
+			e := dummyEmail
+			tt.modify(&e)
+			enc := testEncoder()
+			enc.SMTPUTF8 = smtputf8
+			_, err := enc.Encode(ioutil.Discard, &e)
+			var he *HeaderError
+			if !errors.As(err, &he) || he.Field != tt.field {
+				t.Errorf("%s (SMTPUTF8 %t): expected HeaderError for %q, got %v", tt.name, smtputf8, tt.field, err)
+			}
+		}
+	}
+
+	// Folding whitespace and tabs are allowed.
+	e := dummyEmail
+	e.Subject = "Folded\r\n\tsubject\twith tabs"
+	if _, err := e.MarshalText(); err != nil {
+		t.Errorf("folded subject: %v", err)
+	}
+
+	// Line breaks in file names are encoded, and in content types rejected
+	// when attaching.
+	e.Attachments = nil
+	name := "a.txt\r\nContent-Type: text/html"
+	if err := e.Attach(ioutil.NopCloser(strings.NewReader("x")), name, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("\r\nContent-Type: text/html\r\n")) {
+		t.Errorf("file name injected a header field:\n%s", raw)
+	}
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Attachments) != 1 || got.Attachments[0].Name != name {
+		t.Errorf("file name not preserved: %+v", got.Attachments)
+	}
+	var he *HeaderError
+	if err := e.Attach(ioutil.NopCloser(strings.NewReader("x")), "b.txt", "text/plain\r\nX-Evil: 1"); !errors.As(err, &he) {
+		t.Errorf("expected HeaderError for content type, got %v", err)
+	}
+}
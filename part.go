@@ -0,0 +1,336 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// Part is a MIME entity: a header and either a body or, for multipart and
+// message/rfc822 entities, a list of child parts.
+//
+// Parsed Emails expose their structure through Email.Root. A Part tree may
+// also be built with NewPart and NewMultipart and written with WriteTo, or
+// set as an Email's Root to be sent as its body.
+type Part struct {
+	Header    textproto.MIMEHeader
+	MediaType string            // lowercase, e.g. "text/plain"
+	Params    map[string]string // Content-Type parameters, e.g. "charset"
+
+	// Parts are the children of a multipart entity, or the single
+	// encapsulated message of a message/rfc822 entity.
+	Parts []*Part
+
+	// Body is the body of a non-multipart entity as it is transmitted,
+	// i.e. still in its Content-Transfer-Encoding. See Decoded.
+	Body []byte
+
+	// Raw is the exact data the Part was parsed from, header included. If
+	// non-nil, it is written verbatim in place of the other fields, so it
+	// must be set to nil after modifying a parsed Part.
+	Raw []byte
+
+	// src, if non-nil, is streamed as base64 in place of Body.
+	src io.Reader
+}
+
+// NewPart returns a Part of the given media type holding body, which is
+// transfer-encoded as quoted-printable for text types and base64 otherwise.
+func NewPart(mediaType string, params map[string]string, body []byte) *Part {
+	p := &Part{
+		Header:    make(textproto.MIMEHeader),
+		MediaType: mediaType,
+		Params:    params,
+	}
+	var buf bytes.Buffer
+	if strings.HasPrefix(mediaType, "text/") {
+		p.Header.Set(contentXferEncoding, "quoted-printable")
+		qp := quotedprintable.NewWriter(&buf)
+		qp.Write(body)
+		qp.Close()
+	} else {
+		p.Header.Set(contentXferEncoding, "base64")
+		cw := chunkWriter{w: &buf}
+		enc := base64.NewEncoder(base64.StdEncoding, &cw)
+		enc.Write(body)
+		enc.Close()
+		cw.Close()
+	}
+	p.Body = buf.Bytes()
+	return p
+}
+
+// NewMultipart returns a multipart Part of the given media type, e.g.
+// "multipart/mixed", with the given children. A boundary is chosen when the
+// Part is written.
+func NewMultipart(mediaType string, parts ...*Part) *Part {
+	return &Part{
+		Header:    make(textproto.MIMEHeader),
+		MediaType: mediaType,
+		Params:    make(map[string]string),
+		Parts:     parts,
+	}
+}
+
+// IsMultipart reports whether p is a multipart entity.
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.MediaType, "multipart/")
+}
+
+// Decoded returns p's body with its Content-Transfer-Encoding undone.
+func (p *Part) Decoded() ([]byte, error) {
+	return ioutil.ReadAll(decodeTransfer(p.Header, bytes.NewReader(p.Body)))
+}
+
+// Walk calls fn for p and each of its descendants, depth first. If fn
+// returns an error, Walk stops and returns it.
+func (p *Part) Walk(fn func(*Part) error) error {
+	if err := fn(p); err != nil {
+		return err
+	}
+	for _, c := range p.Parts {
+		if err := c.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaves returns the parts under p that carry content: non-multipart parts,
+// including message/rfc822 parts, whose children are not visited.
+func (p *Part) leaves() []*Part {
+	if !p.IsMultipart() {
+		return []*Part{p}
+	}
+	var ps []*Part
+	for _, c := range p.Parts {
+		ps = append(ps, c.leaves()...)
+	}
+	return ps
+}
+
+// isAttachment reports whether p should be treated as an attachment rather
+// than as the text or HTML body.
+func (p *Part) isAttachment() bool {
+	if v := p.Header.Get(contentDispo); v != "" {
+		if dispo, _, err := mime.ParseMediaType(v); err == nil && dispo == "attachment" {
+			return true
+		}
+	}
+	return p.MediaType != "text/plain" && p.MediaType != "text/html"
+}
+
+// Filename returns the file name of p, taken from the Content-Disposition
+// filename parameter or, failing that, the Content-Type name parameter. RFC
+// 2231 and RFC 2047 encoded names are decoded.
+func (p *Part) Filename() string {
+	return filename(p.Header, new(mime.WordDecoder))
+}
+
+// attachment converts p, whose decoded body is body, into an Attachment named
+// using dec to decode encoded-words.
+func (p *Part) attachment(body []byte, dec *mime.WordDecoder) Attachment {
+	return Attachment{
+		Name:   filename(p.Header, dec),
+		Header: p.Header,
+		Body:   readSeekNopCloser{bytes.NewReader(body)},
+	}
+}
+
+// WriteTo writes p, header and body, to w. It implements io.WriterTo.
+func (p *Part) WriteTo(w io.Writer) (int64, error) {
+	cw := countWriter{w: w}
+	err := p.writeTo(&cw, new(Encoder))
+	return cw.n, err
+}
+
+func (p *Part) writeTo(w io.Writer, enc *Encoder) error {
+	if p.Raw != nil {
+		_, err := w.Write(p.Raw)
+		return err
+	}
+	h := p.header(enc)
+	if err := writeHeader(w, h, fieldOrder(h, nil, nil), enc.SMTPUTF8); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, lineEnding); err != nil {
+		return err
+	}
+	return p.writeBody(w, enc)
+}
+
+// header returns the header to write for p, with Content-Type derived from
+// MediaType and Params. Multipart parts are given a boundary from enc if they
+// have none.
+func (p *Part) header(enc *Encoder) textproto.MIMEHeader {
+	if p.Raw != nil || p.MediaType == "" {
+		return canonicalKeys(p.Header)
+	}
+	if p.IsMultipart() && p.Params["boundary"] == "" {
+		if p.Params == nil {
+			p.Params = make(map[string]string)
+		}
+		p.Params["boundary"] = enc.boundary()
+	}
+	h := make(textproto.MIMEHeader, len(p.Header)+1)
+	for k, v := range canonicalKeys(p.Header) {
+		h[k] = v
+	}
+	h.Set(contentType, mime.FormatMediaType(p.MediaType, p.Params))
+	return h
+}
+
+// writeBody writes p's body, which for multipart parts includes its children.
+// header must have been called first so that p has a boundary.
+func (p *Part) writeBody(w io.Writer, enc *Encoder) error {
+	if p.Raw != nil {
+		_, body := splitHeader(p.Raw)
+		_, err := w.Write(body)
+		return err
+	}
+	if p.src != nil {
+		cw := chunkWriter{w: w}
+		enc := base64.NewEncoder(base64.StdEncoding, &cw)
+		if _, err := io.Copy(enc, p.src); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		return cw.Close()
+	}
+	if !p.IsMultipart() {
+		_, err := w.Write(p.Body)
+		return err
+	}
+	b := p.Params["boundary"]
+	for _, c := range p.Parts {
+		if _, err := fmt.Fprintf(w, "--%s\r\n", b); err != nil {
+			return err
+		}
+		if err := c.writeTo(w, enc); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, lineEnding); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "--%s--\r\n", b)
+	return err
+}
+
+// parsePart parses raw as a MIME entity, recursing into multipart and
+// message/rfc822 bodies.
+func parsePart(raw []byte) (*Part, error) {
+	hdr, body := splitHeader(raw)
+	if body == nil {
+		// No blank line: the whole entity is header.
+		hdr = append(append([]byte(nil), hdr...), "\r\n\r\n"...)
+	}
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(hdr))).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	mtyp, params, err := parseMediaType(h)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Part{Header: h, MediaType: mtyp, Params: params, Raw: raw}
+	switch {
+	case p.IsMultipart():
+		raws, err := splitMultipart(body, params["boundary"])
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range raws {
+			c, err := parsePart(r)
+			if err != nil {
+				return nil, err
+			}
+			p.Parts = append(p.Parts, c)
+		}
+	case mtyp == "message/rfc822":
+		p.Body = body
+		// The encapsulated message is informational; a malformed one does
+		// not make the outer message unreadable.
+		if inner, err := p.Decoded(); err == nil {
+			if m, err := parsePart(inner); err == nil {
+				p.Parts = []*Part{m}
+			}
+		}
+	default:
+		p.Body = body
+	}
+	return p, nil
+}
+
+// splitHeader splits raw at the first empty line. The header includes the
+// empty line. If there is no empty line, body is nil.
+func splitHeader(raw []byte) (header, body []byte) {
+	for i := 0; i < len(raw); {
+		j := bytes.IndexByte(raw[i:], '\n')
+		if j < 0 {
+			break
+		}
+		if line := raw[i : i+j]; len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return raw[:i+j+1], raw[i+j+1:]
+		}
+		i += j + 1
+	}
+	return raw, nil
+}
+
+// splitMultipart returns the raw body parts of a multipart body. The line
+// break before each delimiter line belongs to the delimiter, per RFC 2046.
+// A missing close delimiter is tolerated.
+func splitMultipart(body []byte, boundary string) ([][]byte, error) {
+	if boundary == "" {
+		return nil, ErrMissingBoundary
+	}
+	delim := []byte("--" + boundary)
+
+	var (
+		parts [][]byte
+		start = -1 // start of the current part; -1 in the preamble
+	)
+	for i := 0; i < len(body); {
+		next := len(body)
+		if j := bytes.IndexByte(body[i:], '\n'); j >= 0 {
+			next = i + j + 1
+		}
+		line := bytes.TrimRight(body[i:next], " \t\r\n")
+		if bytes.HasPrefix(line, delim) {
+			rest := line[len(delim):]
+			final := string(rest) == "--"
+			if len(rest) == 0 || final {
+				if start >= 0 {
+					end := i
+					if end > start && body[end-1] == '\n' {
+						end--
+						if end > start && body[end-1] == '\r' {
+							end--
+						}
+					}
+					parts = append(parts, body[start:end])
+				}
+				if final {
+					return parts, nil
+				}
+				start = next
+			}
+		}
+		i = next
+	}
+	if start >= 0 {
+		parts = append(parts, body[start:])
+	}
+	return parts, nil
+}
@@ -0,0 +1,214 @@
+package email
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const nestedMessage = "From: foo@example.com\r\n" +
+	"To: bar@example.com\r\n" +
+	"Subject: nested\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"This is the preamble.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/signed; boundary=inner;\r\n" +
+	"    micalg=pgp-sha1; protocol=\"application/pgp-signature\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Signed text.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: application/pgp-signature\r\n" +
+	"\r\n" +
+	"SIGNATURE\r\n" +
+	"--inner--\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: baz@example.com\r\n" +
+	"Subject: forwarded\r\n" +
+	"\r\n" +
+	"Forwarded body.\r\n" +
+	"--outer--\r\n" +
+	"This is the epilogue.\r\n"
+
+func TestNew_PartTree(t *testing.T) {
+	e, err := New(strings.NewReader(nestedMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := e.Root
+	if root == nil || root.MediaType != "multipart/mixed" || len(root.Parts) != 2 {
+		t.Fatalf("unexpected root: %+v", root)
+	}
+	if root.Header.Get("Subject") != "" || root.Header.Get(contentType) != e.Headers.Get(contentType) {
+		t.Error("message and content headers were not separated")
+	}
+
+	signed := root.Parts[0]
+	if signed.MediaType != "multipart/signed" {
+		t.Fatalf("expected multipart/signed, got %q", signed.MediaType)
+	}
+	if signed.Params["protocol"] != "application/pgp-signature" || signed.Params["micalg"] != "pgp-sha1" {
+		t.Errorf("wrong params: %v", signed.Params)
+	}
+	if len(signed.Parts) != 2 {
+		t.Fatalf("expected 2 signed parts, got %d", len(signed.Parts))
+	}
+	if want := "Content-Type: text/plain\r\n\r\nSigned text."; string(signed.Parts[0].Raw) != want {
+		t.Errorf("wrong raw signed part:\nwant: %q\ngot : %q", want, signed.Parts[0].Raw)
+	}
+
+	fwd := root.Parts[1]
+	if fwd.MediaType != "message/rfc822" || len(fwd.Parts) != 1 {
+		t.Fatalf("unexpected message/rfc822 part: %+v", fwd)
+	}
+	if s := fwd.Parts[0].Header.Get("Subject"); s != "forwarded" {
+		t.Errorf("wrong encapsulated subject: %q", s)
+	}
+
+	var types []string
+	root.Walk(func(p *Part) error {
+		types = append(types, p.MediaType)
+		return nil
+	})
+	want := []string{
+		"multipart/mixed", "multipart/signed", "text/plain",
+		"application/pgp-signature", "message/rfc822", "text/plain",
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("wrong walk order:\nwant: %q\ngot : %q", want, types)
+	}
+
+	// With KeepBody, writing a parsed Email keeps its body byte for byte.
+	p := Parser{KeepBody: true}
+	if e, err = p.Parse(strings.NewReader(nestedMessage)); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body := splitHeader([]byte(nestedMessage)); !bytes.HasSuffix(raw, body) {
+		t.Errorf("body was not preserved:\n%s", raw)
+	}
+}
+
+func TestNew_EditParsed(t *testing.T) {
+	e, err := New(strings.NewReader(nestedMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Text = []byte("CHANGED")
+	if err := e.Attach(ioutil.NopCloser(strings.NewReader("new")), "new.txt", "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Text) != "CHANGED" {
+		t.Errorf("edited text was not written: %q", got.Text)
+	}
+	if n := len(got.Attachments); n != 3 || got.Attachments[n-1].Name != "new.txt" {
+		t.Errorf("new attachment was not written: %+v", got.Attachments)
+	}
+	if bytes.Contains(raw, []byte("outer")) {
+		t.Errorf("original content fields were written:\n%s", raw)
+	}
+}
+
+func TestPart_Build(t *testing.T) {
+	text := NewPart("text/plain", map[string]string{"charset": "UTF-8"}, []byte("héllo\r\n"))
+	img := NewPart("image/png", nil, []byte("\x89PNG fake"))
+	img.Header.Set(contentID, "<img1@example.com>")
+	root := NewMultipart("multipart/related", text, img)
+
+	e := Email{
+		From: "foo@example.com",
+		To:   []string{"bar@example.com"},
+		Root: root,
+	}
+	raw, err := e.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Root.MediaType != "multipart/related" || len(got.Root.Parts) != 2 {
+		t.Fatalf("unexpected structure: %+v", got.Root)
+	}
+	if string(got.Text) != "héllo\r\n" {
+		t.Errorf("wrong text: %q", got.Text)
+	}
+	body, err := got.Root.Parts[1].Decoded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "\x89PNG fake" {
+		t.Errorf("wrong image body: %q", body)
+	}
+	if id := got.Root.Parts[1].Header.Get(contentID); id != "<img1@example.com>" {
+		t.Errorf("wrong Content-ID: %q", id)
+	}
+}
+
+func TestWriteTo_Count(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewPart("text/plain", map[string]string{"charset": "UTF-8"}, []byte("héllo\r\n"))
+	if n, err := p.WriteTo(&buf); err != nil || n != int64(buf.Len()) {
+		t.Errorf("Part.WriteTo returned %d, %v; wrote %d bytes", n, err, buf.Len())
+	}
+
+	e := dummyEmail
+	buf.Reset()
+	if n, err := e.WriteTo(&buf); err != nil || n != int64(buf.Len()) {
+		t.Errorf("Email.WriteTo returned %d, %v; wrote %d bytes", n, err, buf.Len())
+	}
+	buf.Reset()
+	if n, err := testEncoder().Encode(&buf, &e); err != nil || n != int64(buf.Len()) {
+		t.Errorf("Encoder.Encode returned %d, %v; wrote %d bytes", n, err, buf.Len())
+	}
+}
+
+func TestSplitMultipart(t *testing.T) {
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{"--b\r\na\r\n--b\r\nb\r\n--b--\r\n", []string{"a", "b"}},
+		{"pre\n--b\nLF only\n--b--\n", []string{"LF only"}},
+		{"--b\r\n\r\n--b-- \r\n", []string{""}},
+		{"--b\r\n--bx\r\n--b--", []string{"--bx"}},
+		{"--b\r\nunterminated", []string{"unterminated"}},
+	}
+	for _, tt := range tests {
+		raws, err := splitMultipart([]byte(tt.body), "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(raws))
+		for i, r := range raws {
+			got[i] = string(r)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitMultipart(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+	if _, err := splitMultipart(nil, ""); err != ErrMissingBoundary {
+		t.Errorf("expected ErrMissingBoundary, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package email
+
+import (
+	"errors"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// ErrNotPGP is returned when reading a Part that is not a PGP/MIME signed or
+// encrypted entity as one.
+var ErrNotPGP = errors.New("email: not a PGP/MIME entity")
+
+var errSMIMEAndPGP = errors.New("email: cannot use both S/MIME and PGP/MIME")
+
+// PGPSigner makes OpenPGP signatures for PGP/MIME. This package does not
+// implement OpenPGP itself; implement PGPSigner and the other PGP interfaces
+// with an OpenPGP library or by running gpg.
+type PGPSigner interface {
+	// SignDetached returns an ASCII-armored detached signature of data,
+	// and the hash algorithm used as named by the micalg parameter of RFC
+	// 3156, e.g. "pgp-sha256".
+	SignDetached(data []byte) (sig []byte, micalg string, err error)
+}
+
+// PGPEncrypter encrypts messages for PGP/MIME.
+type PGPEncrypter interface {
+	// Encrypt returns data encrypted for the message's recipients as an
+	// ASCII-armored OpenPGP message.
+	Encrypt(data []byte) ([]byte, error)
+}
+
+// PGPVerifier verifies OpenPGP signatures. See VerifyPGP.
+type PGPVerifier interface {
+	// VerifyDetached verifies the detached signature sig of data.
+	VerifyDetached(data, sig []byte) error
+}
+
+// PGPDecrypter decrypts OpenPGP messages. See DecryptPGP.
+type PGPDecrypter interface {
+	// Decrypt decrypts the OpenPGP message msg, which may be
+	// ASCII-armored.
+	Decrypt(msg []byte) ([]byte, error)
+}
+
+// PGP signs and/or encrypts messages with PGP/MIME, as described in RFC
+// 3156. Set it in Encoder.PGP to do so as messages are written or sent.
+//
+// The message body, including attachments, is signed or encrypted. The
+// header fields of the message itself, such as Subject, are not.
+type PGP struct {
+	// Signer, if set, signs messages, which are then sent as
+	// multipart/signed.
+	Signer PGPSigner
+
+	// Encrypter, if set, encrypts messages, which are then sent as
+	// multipart/encrypted. Messages that are also signed are signed first,
+	// as described in RFC 3156, section 6.1.
+	Encrypter PGPEncrypter
+}
+
+// wrap returns root signed and/or encrypted as configured in pg, using enc to
+// write it.
+func (pg *PGP) wrap(root *Part, enc *Encoder) (*Part, error) {
+	if pg.Signer != nil {
+		content, err := entityBytes(root, enc)
+		if err != nil {
+			return nil, err
+		}
+		sig, micalg, err := pg.Signer.SignDetached(content)
+		if err != nil {
+			return nil, err
+		}
+		inner, err := parsePart(content)
+		if err != nil {
+			return nil, err
+		}
+		root = NewMultipart("multipart/signed", inner, armoredPart("application/pgp-signature", "attachment", "signature.asc", sig))
+		root.Params["protocol"] = "application/pgp-signature"
+		root.Params["micalg"] = strings.ToLower(micalg)
+	}
+	if pg.Encrypter != nil {
+		content, err := entityBytes(root, enc)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := pg.Encrypter.Encrypt(content)
+		if err != nil {
+			return nil, err
+		}
+		control := &Part{
+			Header:    make(textproto.MIMEHeader),
+			MediaType: "application/pgp-encrypted",
+			Body:      []byte("Version: 1" + lineEnding),
+		}
+		root = NewMultipart("multipart/encrypted", control, armoredPart("application/octet-stream", "inline", "encrypted.asc", msg))
+		root.Params["protocol"] = "application/pgp-encrypted"
+	}
+	return root, nil
+}
+
+// armoredPart returns a Part holding the ASCII-armored data, which needs no
+// transfer encoding, with the given disposition and file name.
+func armoredPart(mediaType, dispo, filename string, data []byte) *Part {
+	p := &Part{
+		Header:    make(textproto.MIMEHeader),
+		MediaType: mediaType,
+		Params:    map[string]string{"name": filename},
+		Body:      toCRLF(data),
+	}
+	p.Header.Set(contentDispo, mime.FormatMediaType(dispo, map[string]string{"filename": filename}))
+	return p
+}
+
+// PGPSignature returns the signed data and the detached signature of p, a
+// PGP/MIME multipart/signed entity such as the Root of a parsed Email or one
+// of its descendants. The signed data is the exact first child of p, with CRLF
+// line endings as RFC 3156 requires for verification.
+func (p *Part) PGPSignature() (data, sig []byte, err error) {
+	if p.MediaType != "multipart/signed" || strings.ToLower(p.Params["protocol"]) != "application/pgp-signature" ||
+		len(p.Parts) != 2 || p.Parts[1].MediaType != "application/pgp-signature" {
+		return nil, nil, ErrNotPGP
+	}
+	if p.Parts[0].Raw == nil {
+		return nil, nil, ErrNoRawMessage
+	}
+	sig, err = p.Parts[1].Decoded()
+	if err != nil {
+		return nil, nil, err
+	}
+	return toCRLF(p.Parts[0].Raw), sig, nil
+}
+
+// PGPEncrypted returns the OpenPGP message of p, a PGP/MIME
+// multipart/encrypted entity such as the Root of a parsed Email.
+func (p *Part) PGPEncrypted() ([]byte, error) {
+	if p.MediaType != "multipart/encrypted" || strings.ToLower(p.Params["protocol"]) != "application/pgp-encrypted" ||
+		len(p.Parts) != 2 || p.Parts[0].MediaType != "application/pgp-encrypted" {
+		return nil, ErrNotPGP
+	}
+	return p.Parts[1].Decoded()
+}
+
+// VerifyPGP verifies the signature of p, a PGP/MIME multipart/signed entity,
+// with v and returns the signed entity.
+func VerifyPGP(p *Part, v PGPVerifier) (*Part, error) {
+	data, sig, err := p.PGPSignature()
+	if err != nil {
+		return nil, err
+	}
+	if err := v.VerifyDetached(data, sig); err != nil {
+		return nil, err
+	}
+	return parsePart(data)
+}
+
+// DecryptPGP decrypts p, a PGP/MIME multipart/encrypted entity, with d and
+// returns the entity it contains. If that is signed, its signature can be
+// verified with VerifyPGP.
+func DecryptPGP(p *Part, d PGPDecrypter) (*Part, error) {
+	msg, err := p.PGPEncrypted()
+	if err != nil {
+		return nil, err
+	}
+	content, err := d.Decrypt(msg)
+	if err != nil {
+		return nil, err
+	}
+	return parsePart(content)
+}
@@ -0,0 +1,150 @@
+package email
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakePGP stands in for an OpenPGP implementation. It "signs" with an HMAC
+// and "encrypts" with base64, both ASCII-armored.
+type fakePGP struct {
+	key []byte
+}
+
+func (f fakePGP) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, f.key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func armor(typ string, data []byte) []byte {
+	return []byte("-----BEGIN PGP " + typ + "-----\n\n" +
+		base64.StdEncoding.EncodeToString(data) +
+		"\n-----END PGP " + typ + "-----\n")
+}
+
+func dearmor(msg []byte) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(strings.Replace(string(msg), "\r\n", "\n", -1)), "\n")
+	if len(lines) != 4 {
+		return nil, errors.New("malformed armor")
+	}
+	return base64.StdEncoding.DecodeString(lines[2])
+}
+
+func (f fakePGP) SignDetached(data []byte) ([]byte, string, error) {
+	return armor("SIGNATURE", f.mac(data)), "PGP-SHA256", nil
+}
+
+func (f fakePGP) VerifyDetached(data, sig []byte) error {
+	mac, err := dearmor(sig)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, f.mac(data)) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func (f fakePGP) Encrypt(data []byte) ([]byte, error) {
+	return armor("MESSAGE", data), nil
+}
+
+func (f fakePGP) Decrypt(msg []byte) ([]byte, error) {
+	return dearmor(msg)
+}
+
+func TestPGP(t *testing.T) {
+	pgp := fakePGP{key: []byte("secret")}
+	encode := func(p *PGP) (*Email, []byte) {
+		t.Helper()
+		e := dummyEmail
+		enc := testEncoder()
+		enc.PGP = p
+		var buf bytes.Buffer
+		if _, err := enc.Encode(&buf, &e); err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := New(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed, buf.Bytes()
+	}
+
+	e, raw := encode(&PGP{Signer: pgp})
+	if e.Root.MediaType != "multipart/signed" || e.Root.Params["micalg"] != "pgp-sha256" {
+		t.Fatalf("wrong root %s %v", e.Root.MediaType, e.Root.Params)
+	}
+	if !bytes.Contains(raw, []byte("\r\n-----BEGIN PGP SIGNATURE-----\r\n")) {
+		t.Errorf("signature is not ASCII-armored as is:\n%s", raw)
+	}
+	inner, err := VerifyPGP(e.Root, pgp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.MediaType != "multipart/alternative" {
+		t.Errorf("wrong signed entity %s", inner.MediaType)
+	}
+	tampered, err := New(bytes.NewReader(bytes.Replace(raw, []byte("Fancy"), []byte("Plain"), 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyPGP(tampered.Root, pgp); err == nil {
+		t.Error("verified a tampered message")
+	}
+
+	e, raw = encode(&PGP{Signer: pgp, Encrypter: pgp})
+	if e.Root.MediaType != "multipart/encrypted" || bytes.Contains(raw, []byte("Fancy")) {
+		t.Fatalf("wrong root %s:\n%s", e.Root.MediaType, raw)
+	}
+	signed, err := DecryptPGP(e.Root, pgp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner, err = VerifyPGP(signed, pgp); err != nil {
+		t.Fatal(err)
+	}
+	if inner.MediaType != "multipart/alternative" {
+		t.Errorf("wrong signed entity %s", inner.MediaType)
+	}
+
+	if _, err := VerifyPGP(e.Root, pgp); err != ErrNotPGP {
+		t.Errorf("expected ErrNotPGP, got %v", err)
+	}
+	enc := testEncoder()
+	enc.PGP = &PGP{Signer: pgp}
+	enc.SMIME = &SMIME{}
+	if _, err := enc.Encode(new(bytes.Buffer), &dummyEmail); err != errSMIMEAndPGP {
+		t.Errorf("expected errSMIMEAndPGP, got %v", err)
+	}
+}
+
+func TestPart_PGPSignature(t *testing.T) {
+	e, err := New(bytes.NewReader(pgpSignedMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := e.Root.Parts[0]
+	data, sig, err := signed.PGPSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Content-Transfer-Encoding: quoted-printable\r\n\r\nTwas brillig"; !strings.HasPrefix(string(data), want) {
+		t.Errorf("signed data %q does not start with %q", data, want)
+	}
+	if !strings.HasSuffix(string(data), "gimble:\r\n") {
+		t.Errorf("signed data %q includes the line break before the delimiter", data)
+	}
+	if !strings.HasPrefix(string(sig), "-----BEGIN PGP SIGNATURE-----\n") {
+		t.Errorf("wrong signature %q", sig)
+	}
+	if _, _, err := e.Root.PGPSignature(); err != ErrNotPGP {
+		t.Errorf("expected ErrNotPGP, got %v", err)
+	}
+}
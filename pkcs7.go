@@ -0,0 +1,533 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// This file implements the subset of CMS (RFC 5652), the successor of PKCS
+// #7, that S/MIME needs: SignedData with signed attributes, and EnvelopedData
+// with RSA key transport and AES-CBC content encryption. Only DER is read;
+// BER's indefinite lengths are not supported.
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttrContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSA             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+var (
+	errPKCS7Malformed   = errors.New("email: malformed PKCS #7 data")
+	errPKCS7Unsupported = errors.New("email: unsupported PKCS #7 content or algorithm")
+	errPKCS7Signature   = errors.New("email: PKCS #7 signature did not verify")
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// pkcs7Signature is a verified SignedData signature.
+type pkcs7Signature struct {
+	content []byte
+	signer  *x509.Certificate
+	certs   []*x509.Certificate // all included certificates
+}
+
+// signPKCS7 returns a DER-encoded ContentInfo holding a detached SignedData
+// signature of content by key, the private key of cert, made at time now.
+// cert and chain are included for the benefit of verifiers.
+func signPKCS7(content []byte, cert *x509.Certificate, key crypto.Signer, chain []*x509.Certificate, now time.Time) ([]byte, error) {
+	var sigAlg pkix.AlgorithmIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, errSMIMEKey
+	}
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+	var attrs [][]byte
+	for _, a := range []struct {
+		typ asn1.ObjectIdentifier
+		val interface{}
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrSigningTime, now.UTC()},
+		{oidAttrMessageDigest, digest.Sum(nil)},
+	} {
+		val, err := asn1.Marshal(a.val)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(attribute{a.typ, asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: val}})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	// DER orders the elements of a SET OF by their encodings.
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	signedAttrs := bytes.Join(attrs, nil)
+
+	// The signature covers the attributes with an explicit SET OF tag
+	// (RFC 5652, section 5.4).
+	set, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signedAttrs})
+	if err != nil {
+		return nil, err
+	}
+	h := crypto.SHA256.New()
+	h.Write(set)
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sid, err := asn1.Marshal(issuerAndSerial{asn1.RawValue{FullBytes: cert.RawIssuer}, cert.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+	si, err := asn1.Marshal(signerInfo{
+		Version:            1,
+		SID:                asn1.RawValue{FullBytes: sid},
+		DigestAlgorithm:    digestAlg,
+		SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedAttrs},
+		SignatureAlgorithm: sigAlg,
+		Signature:          sig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var certs []byte
+	for _, c := range append([]*x509.Certificate{cert}, chain...) {
+		certs = append(certs, c.Raw...)
+	}
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		ContentInfo:      contentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos:      []asn1.RawValue{{FullBytes: si}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return marshalContentInfo(oidSignedData, sd)
+}
+
+// marshalContentInfo returns the DER encoding of a ContentInfo of the given
+// type holding the DER-encoded content.
+func marshalContentInfo(typ asn1.ObjectIdentifier, content []byte) ([]byte, error) {
+	// asn1 ignores the explicit tag of RawValues, so it is added here, and
+	// unmarshaling leaves it in place.
+	return asn1.Marshal(contentInfo{typ, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content}})
+}
+
+// verifyPKCS7 verifies the DER-encoded SignedData ContentInfo der. If
+// detached is non-nil, it is the signed content; otherwise the content is
+// taken from der. The signature is checked against the signer's certificate
+// only; building a chain to a trusted root is left to the caller.
+func verifyPKCS7(der, detached []byte) (*pkcs7Signature, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, errPKCS7Malformed
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errPKCS7Unsupported
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, errPKCS7Malformed
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidData) {
+		return nil, errPKCS7Unsupported
+	}
+
+	s := pkcs7Signature{content: detached}
+	if s.content == nil {
+		var octets []byte
+		if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &octets); err != nil {
+			return nil, errPKCS7Malformed
+		}
+		s.content = octets
+	}
+	if len(sd.Certificates.Bytes) > 0 {
+		certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = certs
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, errPKCS7Malformed
+	}
+
+	var err error
+	for _, raw := range sd.SignerInfos {
+		var si signerInfo
+		if _, err = asn1.Unmarshal(raw.FullBytes, &si); err != nil {
+			err = errPKCS7Malformed
+			continue
+		}
+		if s.signer, err = verifySignerInfo(&si, s.content, s.certs); err == nil {
+			return &s, nil
+		}
+	}
+	return nil, err
+}
+
+// verifySignerInfo verifies the signature si of content, made with one of
+// certs, and returns the signer's certificate.
+func verifySignerInfo(si *signerInfo, content []byte, certs []*x509.Certificate) (*x509.Certificate, error) {
+	var signer *x509.Certificate
+	for _, c := range certs {
+		if matchesIdentifier(c, si.SID) {
+			signer = c
+			break
+		}
+	}
+	if signer == nil {
+		return nil, errors.New("email: PKCS #7 signer certificate not included")
+	}
+	hash, ok := digestAlgorithm(si.DigestAlgorithm.Algorithm)
+	if !ok {
+		return nil, errPKCS7Unsupported
+	}
+	alg := pkcs7SignatureAlgorithm(si.SignatureAlgorithm.Algorithm, hash)
+	if alg == x509.UnknownSignatureAlgorithm {
+		return nil, errPKCS7Unsupported
+	}
+
+	signed := content
+	if len(si.SignedAttrs.FullBytes) > 0 {
+		var (
+			digest      []byte
+			contentType asn1.ObjectIdentifier
+		)
+		for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+			var (
+				a   attribute
+				err error
+			)
+			if rest, err = asn1.Unmarshal(rest, &a); err != nil {
+				return nil, errPKCS7Malformed
+			}
+			switch {
+			case a.Type.Equal(oidAttrMessageDigest):
+				_, err = asn1.Unmarshal(a.Values.Bytes, &digest)
+			case a.Type.Equal(oidAttrContentType):
+				_, err = asn1.Unmarshal(a.Values.Bytes, &contentType)
+			}
+			if err != nil {
+				return nil, errPKCS7Malformed
+			}
+		}
+		if !contentType.Equal(oidData) {
+			return nil, errPKCS7Malformed
+		}
+		h := hash.New()
+		h.Write(content)
+		if !bytes.Equal(digest, h.Sum(nil)) {
+			return nil, errPKCS7Signature
+		}
+		signed = append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...) // SET OF
+	}
+	if err := signer.CheckSignature(alg, signed, si.Signature); err != nil {
+		return nil, errPKCS7Signature
+	}
+	return signer, nil
+}
+
+// encryptPKCS7 returns a DER-encoded ContentInfo holding content as
+// EnvelopedData for recipients, which must have RSA keys. The content is
+// encrypted with AES-256-CBC.
+func encryptPKCS7(content []byte, recipients []*x509.Certificate) ([]byte, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(content)%aes.BlockSize
+	ciphertext := append(append([]byte(nil), content...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	var infos []asn1.RawValue
+	for _, r := range recipients {
+		pub, ok := r.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, errSMIMERecipientKey
+		}
+		encKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, err
+		}
+		rid, err := asn1.Marshal(issuerAndSerial{asn1.RawValue{FullBytes: r.RawIssuer}, r.SerialNumber})
+		if err != nil {
+			return nil, err
+		}
+		info, err := asn1.Marshal(keyTransRecipientInfo{
+			RID:                    asn1.RawValue{FullBytes: rid},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, asn1.RawValue{FullBytes: info})
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	ed, err := asn1.Marshal(envelopedData{
+		RecipientInfos: infos,
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return marshalContentInfo(oidEnvelopedData, ed)
+}
+
+// decryptPKCS7 decrypts the DER-encoded EnvelopedData ContentInfo der with
+// key, the private key of cert, which must be one of its recipients.
+func decryptPKCS7(der []byte, cert *x509.Certificate, key crypto.Decrypter) ([]byte, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, errPKCS7Malformed
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, errPKCS7Unsupported
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, errPKCS7Malformed
+	}
+
+	var encKey []byte
+	for _, raw := range ed.RecipientInfos {
+		// Other kinds of RecipientInfo have context-specific tags.
+		if raw.Class != asn1.ClassUniversal || raw.Tag != asn1.TagSequence {
+			continue
+		}
+		var ktri keyTransRecipientInfo
+		if _, err := asn1.Unmarshal(raw.FullBytes, &ktri); err != nil {
+			return nil, errPKCS7Malformed
+		}
+		if matchesIdentifier(cert, ktri.RID) {
+			if !ktri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSA) {
+				return nil, errPKCS7Unsupported
+			}
+			encKey = ktri.EncryptedKey
+			break
+		}
+	}
+	if encKey == nil {
+		return nil, ErrNotSMIMERecipient
+	}
+	cek, err := key.Decrypt(rand.Reader, encKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	eci := ed.EncryptedContentInfo
+	keyLen := map[string]int{
+		oidAES128CBC.String(): 16,
+		oidAES192CBC.String(): 24,
+		oidAES256CBC.String(): 32,
+	}[eci.ContentEncryptionAlgorithm.Algorithm.String()]
+	if keyLen == 0 {
+		return nil, errPKCS7Unsupported
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errPKCS7Malformed
+	}
+	if len(cek) != keyLen {
+		return nil, errPKCS7Malformed
+	}
+	ciphertext := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		// A constructed OCTET STRING, split into segments.
+		ciphertext = nil
+		for rest := eci.EncryptedContent.Bytes; len(rest) > 0; {
+			var (
+				seg []byte
+				err error
+			)
+			if rest, err = asn1.Unmarshal(rest, &seg); err != nil {
+				return nil, errPKCS7Malformed
+			}
+			ciphertext = append(ciphertext, seg...)
+		}
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errPKCS7Malformed
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errPKCS7Malformed
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
+
+// matchesIdentifier reports whether the SignerIdentifier or
+// RecipientIdentifier id identifies c, by issuer and serial number or by
+// subject key identifier.
+func matchesIdentifier(c *x509.Certificate, id asn1.RawValue) bool {
+	if id.Class == asn1.ClassContextSpecific && id.Tag == 0 {
+		return len(c.SubjectKeyId) > 0 && bytes.Equal(id.Bytes, c.SubjectKeyId)
+	}
+	var ias issuerAndSerial
+	if _, err := asn1.Unmarshal(id.FullBytes, &ias); err != nil {
+		return false
+	}
+	return bytes.Equal(ias.Issuer.FullBytes, c.RawIssuer) && ias.Serial.Cmp(c.SerialNumber) == 0
+}
+
+// digestAlgorithm returns the hash identified by oid.
+func digestAlgorithm(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, true
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, true
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, true
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// pkcs7SignatureAlgorithm returns the x509 signature algorithm for the CMS
+// signature algorithm oid with the digest algorithm hash. CMS allows either
+// the bare key algorithm or the combined one.
+func pkcs7SignatureAlgorithm(oid asn1.ObjectIdentifier, hash crypto.Hash) x509.SignatureAlgorithm {
+	var algs map[crypto.Hash]x509.SignatureAlgorithm
+	switch {
+	case oid.Equal(oidRSA), oid.Equal(oidSHA1WithRSA), oid.Equal(oidSHA256WithRSA),
+		oid.Equal(oidSHA384WithRSA), oid.Equal(oidSHA512WithRSA):
+		algs = map[crypto.Hash]x509.SignatureAlgorithm{
+			crypto.SHA1:   x509.SHA1WithRSA,
+			crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA,
+			crypto.SHA512: x509.SHA512WithRSA,
+		}
+	case oid.Equal(oidECPublicKey), oid.Equal(oidECDSAWithSHA1), oid.Equal(oidECDSAWithSHA256),
+		oid.Equal(oidECDSAWithSHA384), oid.Equal(oidECDSAWithSHA512):
+		algs = map[crypto.Hash]x509.SignatureAlgorithm{
+			crypto.SHA1:   x509.ECDSAWithSHA1,
+			crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384,
+			crypto.SHA512: x509.ECDSAWithSHA512,
+		}
+	}
+	return algs[hash]
+}
@@ -0,0 +1,206 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Pool.Send after the Pool has been closed.
+var ErrPoolClosed = errors.New("email: pool is closed")
+
+// ErrTimeout is returned by Pool.Send when the timeout elapses before the
+// message has been sent, whether while waiting for a connection or while
+// sending it.
+var ErrTimeout = errors.New("email: timed out sending")
+
+// defaultHealthCheck is how long a connection may sit idle in a Pool before it
+// is checked with NOOP prior to being reused.
+const defaultHealthCheck = 10 * time.Second
+
+// resetTimeout bounds the RSET and QUIT issued by a Pool outside of a send.
+const resetTimeout = 10 * time.Second
+
+// Pool is a bounded pool of reusable, authenticated SMTP connections. It is
+// safe for concurrent use by multiple goroutines.
+//
+// Connections are dialed lazily, reset with RSET between messages, checked
+// with NOOP after sitting idle, and redialed if they have gone away.
+type Pool struct {
+	// Encoder, if non-nil, is used to serialize messages. It must not be
+	// changed once the Pool is in use.
+	Encoder *Encoder
+
+	// TLSConfig is used for STARTTLS. If nil, a default configuration for
+	// the server's host is used. It must not be changed once the Pool is in
+	// use.
+	TLSConfig *tls.Config
+
+	addr string
+	auth smtp.Auth
+
+	// healthCheck is how long a connection may be idle before it is checked.
+	healthCheck time.Duration
+
+	// slots holds one entry per allowed connection. A nil entry is a slot
+	// that has no live connection and must dial before use.
+	slots     chan *poolConn
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// poolConn is a single SMTP connection owned by a Pool.
+type poolConn struct {
+	conn net.Conn
+	c    *smtp.Client
+	used time.Time
+}
+
+func (pc *poolConn) close() {
+	pc.c.Close()
+}
+
+// NewPool creates a Pool of at most count connections to the SMTP server at
+// addr, authenticating each with a if it is non-nil. No connections are made
+// until the first call to Send.
+func NewPool(addr string, count int, a smtp.Auth) *Pool {
+	if count < 1 {
+		count = 1
+	}
+	p := &Pool{
+		addr:        addr,
+		auth:        a,
+		healthCheck: defaultHealthCheck,
+		slots:       make(chan *poolConn, count),
+		closing:     make(chan struct{}),
+	}
+	for i := 0; i < count; i++ {
+		p.slots <- nil
+	}
+	return p
+}
+
+// Send sends e using a connection from the pool. If no connection becomes
+// available, or the message cannot be delivered, within timeout, the send is
+// aborted.
+func (p *Pool) Send(e *Email, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := p.send(ctx, nil, e)
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return err
+}
+
+// Transport returns a Transport that sends messages using the Pool.
+func (p *Pool) Transport() Transport {
+	return TransportFunc(p.send)
+}
+
+func (p *Pool) send(ctx context.Context, env *Envelope, e *Email) error {
+	var pc *poolConn
+	select {
+	case pc = <-p.slots:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closing:
+		return ErrPoolClosed
+	}
+	select {
+	case <-p.closing:
+		p.slots <- pc
+		return ErrPoolClosed
+	default:
+	}
+
+	pc, err := p.prepare(ctx, pc)
+	if err != nil {
+		p.slots <- nil
+		return ctxErr(ctx, err)
+	}
+
+	stop := watchContext(ctx, pc.conn)
+	dropped, err := e.send(ctx, pc.c, env, p.Encoder)
+	stop()
+	// A failed send may have left the connection mid-transaction; RSET
+	// either recovers it or tells us it is dead. A message that was accepted
+	// is not reported as failed just because the reset afterward was not. A
+	// connection dropped mid-message is never reused.
+	pc.conn.SetDeadline(time.Now().Add(resetTimeout))
+	if dropped {
+		pc = nil
+	} else if rerr := pc.c.Reset(); rerr != nil {
+		pc.close()
+		pc = nil
+	} else {
+		pc.conn.SetDeadline(time.Time{})
+		pc.used = time.Now()
+	}
+	p.slots <- pc
+	return ctxErr(ctx, err)
+}
+
+// prepare returns a usable connection, reusing pc if it is still alive and
+// dialing a new connection otherwise.
+func (p *Pool) prepare(ctx context.Context, pc *poolConn) (*poolConn, error) {
+	if pc != nil {
+		if time.Since(pc.used) < p.healthCheck {
+			return pc, nil
+		}
+		stop := watchContext(ctx, pc.conn)
+		err := pc.c.Noop()
+		stop()
+		if err == nil {
+			pc.conn.SetDeadline(time.Time{})
+			return pc, nil
+		}
+		pc.close()
+	}
+	return p.dial(ctx)
+}
+
+func (p *Pool) dial(ctx context.Context) (*poolConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, conn)
+	c, err := newClient(conn, p.addr, p.auth, p.TLSConfig)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &poolConn{conn: conn, c: c}, nil
+}
+
+// Close closes the Pool. It waits for in-flight sends to finish, then sends
+// QUIT on and closes every open connection. Subsequent calls to Send return
+// ErrPoolClosed.
+func (p *Pool) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		for i := 0; i < cap(p.slots); i++ {
+			pc := <-p.slots
+			if pc == nil {
+				continue
+			}
+			pc.conn.SetDeadline(time.Now().Add(resetTimeout))
+			if qerr := pc.c.Quit(); qerr != nil {
+				pc.close()
+				if err == nil {
+					err = qerr
+				}
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,123 @@
+package email
+
+import (
+	"crypto/tls"
+	"net/smtp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool_Send(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	go s.Serve()
+
+	const (
+		conns = 3
+		sends = 30
+	)
+	p := NewPool(s.Addr(), conns, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, sends)
+	for i := 0; i < sends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e := dummyEmail
+			errs <- p.Send(&e, 5*time.Second)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s.messages()); n != sends {
+		t.Fatalf("expected %d messages, got %d", sends, n)
+	}
+	if n := s.dials(); n > conns {
+		t.Fatalf("expected at most %d connections, got %d", conns, n)
+	}
+
+	e := dummyEmail
+	if err := p.Send(&e, time.Second); err != ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestPool_STARTTLS(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	var client *tls.Config
+	s.tls, client = testTLSConfigs(t)
+	s.user, s.pass = "user", "secret"
+	go s.Serve()
+
+	p := NewPool(s.Addr(), 1, smtp.PlainAuth("", "user", "secret", "127.0.0.1"))
+	defer p.Close()
+	e := dummyEmail
+	if err := p.Send(&e, 5*time.Second); err == nil {
+		t.Fatal("sent over STARTTLS to a server with an untrusted certificate")
+	}
+
+	p = NewPool(s.Addr(), 1, smtp.PlainAuth("", "user", "secret", "127.0.0.1"))
+	p.TLSConfig = client
+	defer p.Close()
+	if err := p.Send(&e, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.messages()); n != 1 {
+		t.Fatalf("expected 1 message, got %d", n)
+	}
+}
+
+func TestPool_Redial(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	go s.Serve()
+
+	p := NewPool(s.Addr(), 1, nil)
+	defer p.Close()
+	p.healthCheck = 0
+
+	e := dummyEmail
+	if err := p.Send(&e, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.dropConns()
+	if err := p.Send(&e, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.dials(); n != 2 {
+		t.Fatalf("expected the dead connection to be redialed, got %d dials", n)
+	}
+	if n := len(s.messages()); n != 2 {
+		t.Fatalf("expected 2 messages, got %d", n)
+	}
+}
+
+func TestPool_Timeout(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	go s.Serve()
+
+	p := NewPool(s.Addr(), 1, nil)
+	defer p.Close()
+
+	// Hold the only connection.
+	pc := <-p.slots
+	defer func() { p.slots <- pc }()
+
+	e := dummyEmail
+	if err := p.Send(&e, 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"mime"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotSMIME is returned when verifying or decrypting a Part that is
+	// not an S/MIME signed or encrypted entity, respectively.
+	ErrNotSMIME = errors.New("email: not an S/MIME entity")
+
+	// ErrNotSMIMERecipient is returned when decrypting a message that was
+	// not encrypted for the decrypting certificate.
+	ErrNotSMIMERecipient = errors.New("email: message not encrypted for this certificate")
+
+	errSMIMEKey          = errors.New("email: S/MIME key must be RSA or ECDSA")
+	errSMIMECertificate  = errors.New("email: S/MIME key has no certificate")
+	errSMIMERecipientKey = errors.New("email: S/MIME recipient key must be RSA")
+	errSMIMEDecrypter    = errors.New("email: S/MIME key cannot decrypt")
+)
+
+// SMIME is an S/MIME identity, as described in RFC 8551. Set it in
+// Encoder.SMIME to sign and/or encrypt messages as they are written or sent,
+// and use its Decrypt method to read messages encrypted for it.
+//
+// The message body, including attachments, is signed or encrypted. The
+// header fields of the message itself, such as Subject, are not.
+//
+// Messages are encrypted with AES-256-CBC, which all S/MIME clients support
+// but which is not authenticated: whoever can modify an encrypted message in
+// transit can alter its decrypted content without this being detected, as in
+// the EFAIL attacks. To guard against this, sign messages as well as
+// encrypting them, and verify the signature of decrypted messages.
+type SMIME struct {
+	// Certificate and Key sign messages, which are sent as multipart/signed
+	// with a detached application/pkcs7-signature. If Key is nil, messages
+	// are not signed; if not, Certificate must be set. Key must be an RSA or
+	// ECDSA key; to decrypt, it must be an RSA key that implements
+	// crypto.Decrypter, as *rsa.PrivateKey does.
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+
+	// Intermediates are included in signatures so that recipients can build
+	// a chain from Certificate to a root they trust.
+	Intermediates []*x509.Certificate
+
+	// Recipients, if not empty, are the certificates of those to encrypt
+	// messages for, which are then sent as application/pkcs7-mime. They
+	// must have RSA keys. The sender's own certificate must be included for
+	// the sender to be able to read the message. Messages that are also
+	// signed are signed first.
+	Recipients []*x509.Certificate
+}
+
+// wrap returns root signed and/or encrypted as configured in s, using enc to
+// write it.
+func (s *SMIME) wrap(root *Part, enc *Encoder) (*Part, error) {
+	if s.Key != nil {
+		if s.Certificate == nil {
+			return nil, errSMIMECertificate
+		}
+		content, err := entityBytes(root, enc)
+		if err != nil {
+			return nil, err
+		}
+		der, err := signPKCS7(content, s.Certificate, s.Key, s.Intermediates, enc.now())
+		if err != nil {
+			return nil, err
+		}
+		inner, err := parsePart(content)
+		if err != nil {
+			return nil, err
+		}
+		root = NewMultipart("multipart/signed", inner, smimePart("application/pkcs7-signature", nil, "smime.p7s", der))
+		root.Params["protocol"] = "application/pkcs7-signature"
+		root.Params["micalg"] = "sha-256"
+	}
+	if len(s.Recipients) > 0 {
+		content, err := entityBytes(root, enc)
+		if err != nil {
+			return nil, err
+		}
+		der, err := encryptPKCS7(content, s.Recipients)
+		if err != nil {
+			return nil, err
+		}
+		params := map[string]string{"smime-type": "enveloped-data"}
+		root = smimePart("application/pkcs7-mime", params, "smime.p7m", der)
+	}
+	return root, nil
+}
+
+// smimePart returns a Part holding the DER data der as an attachment with
+// the given file name, as RFC 8551 recommends for S/MIME entities.
+func smimePart(mediaType string, params map[string]string, filename string, der []byte) *Part {
+	if params == nil {
+		params = make(map[string]string)
+	}
+	params["name"] = filename
+	p := NewPart(mediaType, params, der)
+	p.Header.Set(contentDispo, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	return p
+}
+
+// entityBytes returns p written as a standalone MIME entity in canonical
+// form, with CRLF line endings. The header of a parsed message is reduced to
+// its Content-* fields.
+func entityBytes(p *Part, enc *Encoder) ([]byte, error) {
+	if p.Raw != nil {
+		hdr, body := splitHeader(p.Raw)
+		var b bytes.Buffer
+		for _, f := range splitFields(hdr) {
+			if strings.HasPrefix(strings.ToLower(fieldName(f)), "content-") {
+				b.Write(f)
+			}
+		}
+		b.WriteString(lineEnding)
+		b.Write(body)
+		return toCRLF(b.Bytes()), nil
+	}
+	var buf bytes.Buffer
+	if err := p.writeTo(&buf, enc); err != nil {
+		return nil, err
+	}
+	return toCRLF(buf.Bytes()), nil
+}
+
+// Decrypt decrypts p, an application/pkcs7-mime enveloped-data entity such as
+// the Root of a parsed Email, with s.Certificate and s.Key, and returns the
+// entity it contains. If that is signed, its signature can be verified with
+// an SMIMEVerifier.
+func (s *SMIME) Decrypt(p *Part) (*Part, error) {
+	if s.Certificate == nil {
+		return nil, errSMIMECertificate
+	}
+	if !isPKCS7MIME(p.MediaType) || p.Params["smime-type"] == "signed-data" {
+		return nil, ErrNotSMIME
+	}
+	key, ok := s.Key.(crypto.Decrypter)
+	if !ok {
+		return nil, errSMIMEDecrypter
+	}
+	der, err := p.Decoded()
+	if err != nil {
+		return nil, err
+	}
+	content, err := decryptPKCS7(der, s.Certificate, key)
+	if err != nil {
+		return nil, err
+	}
+	return parsePart(content)
+}
+
+// SMIMEVerifier verifies S/MIME signatures, as described in RFC 8551.
+type SMIMEVerifier struct {
+	// Roots are the trusted root certificates. If nil, the system roots
+	// are used.
+	Roots *x509.CertPool
+
+	// Now returns the time at which the signer's certificate must be
+	// valid. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Verify verifies the S/MIME signature of p, such as the Root of a parsed
+// Email, which must be multipart/signed or application/pkcs7-mime
+// signed-data. It returns the signed entity and the chain from the signer's
+// certificate to a trusted root.
+//
+// Verify does not check that the signer is the sender of the message: the
+// caller should compare the certificate's EmailAddresses to the From field.
+func (v *SMIMEVerifier) Verify(p *Part) (*Part, []*x509.Certificate, error) {
+	var (
+		sig *pkcs7Signature
+		err error
+	)
+	switch {
+	case p.MediaType == "multipart/signed":
+		if !isPKCS7Signature(strings.ToLower(p.Params["protocol"])) || len(p.Parts) != 2 || !isPKCS7Signature(p.Parts[1].MediaType) {
+			return nil, nil, ErrNotSMIME
+		}
+		der, err := p.Parts[1].Decoded()
+		if err != nil {
+			return nil, nil, err
+		}
+		signed := p.Parts[0].Raw
+		if signed == nil {
+			return nil, nil, ErrNoRawMessage
+		}
+		if sig, err = verifyPKCS7(der, toCRLF(signed)); err != nil {
+			return nil, nil, err
+		}
+	case isPKCS7MIME(p.MediaType) && p.Params["smime-type"] == "signed-data":
+		der, err := p.Decoded()
+		if err != nil {
+			return nil, nil, err
+		}
+		if sig, err = verifyPKCS7(der, nil); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, ErrNotSMIME
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range sig.certs {
+		intermediates.AddCert(c)
+	}
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	chains, err := sig.signer.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	inner, err := parsePart(sig.content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inner, chains[0], nil
+}
+
+func isPKCS7Signature(mediaType string) bool {
+	return mediaType == "application/pkcs7-signature" || mediaType == "application/x-pkcs7-signature"
+}
+
+func isPKCS7MIME(mediaType string) bool {
+	return mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime"
+}
@@ -0,0 +1,205 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// smimeCerts holds a test CA and certificates issued by it.
+type smimeCerts struct {
+	roots *x509.CertPool
+	rsa   *SMIME // RSA key, can decrypt
+	ecdsa *SMIME // ECDSA key, can only sign
+}
+
+func newSMIMECerts(t *testing.T) *smimeCerts {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := testEncoder().Now().Add(-time.Hour)
+	ca := issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, caKey, caKey)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := func(serial int64, addr string, key crypto.Signer) *SMIME {
+		cert := issue(t, &x509.Certificate{
+			SerialNumber:   big.NewInt(serial),
+			Subject:        pkix.Name{CommonName: addr},
+			EmailAddresses: []string{addr},
+			NotBefore:      notBefore,
+			NotAfter:       notBefore.AddDate(1, 0, 0),
+			KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		}, ca, key, caKey)
+		return &SMIME{Certificate: cert, Key: key}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return &smimeCerts{
+		roots: roots,
+		rsa:   leaf(2, "test@gmail.com", rsaKey),
+		ecdsa: leaf(3, "test@example.com", ecKey),
+	}
+}
+
+// issue returns the certificate for key described by tmpl, issued by parent
+// with parentKey, or self-signed if parent is nil.
+func issue(t *testing.T, tmpl, parent *x509.Certificate, key, parentKey crypto.Signer) *x509.Certificate {
+	t.Helper()
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// encodeSMIME writes dummyEmail with s and parses the result.
+func encodeSMIME(t *testing.T, s *SMIME) (*Email, []byte) {
+	t.Helper()
+	e := dummyEmail
+	enc := testEncoder()
+	enc.SMIME = s
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, &e); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := New(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed, buf.Bytes()
+}
+
+func TestSMIME_Sign(t *testing.T) {
+	certs := newSMIMECerts(t)
+	v := SMIMEVerifier{Roots: certs.roots, Now: testEncoder().Now}
+
+	for _, s := range []*SMIME{certs.rsa, certs.ecdsa} {
+		e, raw := encodeSMIME(t, s)
+		if e.Root.MediaType != "multipart/signed" || e.Root.Params["micalg"] != "sha-256" {
+			t.Fatalf("%s: wrong root %s %v", s.Certificate.Subject, e.Root.MediaType, e.Root.Params)
+		}
+		if !bytes.Equal(bytes.TrimSpace(e.Text), bytes.TrimSpace(dummyEmail.Text)) {
+			t.Errorf("%s: parsed text %q", s.Certificate.Subject, e.Text)
+		}
+		inner, chain, err := v.Verify(e.Root)
+		if err != nil {
+			t.Fatalf("%s: %v", s.Certificate.Subject, err)
+		}
+		if inner.MediaType != "multipart/alternative" || len(chain) != 2 || !chain[0].Equal(s.Certificate) {
+			t.Errorf("%s: wrong result %s, chain of %d", s.Certificate.Subject, inner.MediaType, len(chain))
+		}
+
+		tampered, err := New(bytes.NewReader(bytes.Replace(raw, []byte("Fancy"), []byte("Plain"), 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := v.Verify(tampered.Root); err != errPKCS7Signature {
+			t.Errorf("%s: tampered message: %v", s.Certificate.Subject, err)
+		}
+	}
+
+	e, _ := encodeSMIME(t, certs.rsa)
+	untrusted := SMIMEVerifier{Roots: x509.NewCertPool(), Now: testEncoder().Now}
+	if _, _, err := untrusted.Verify(e.Root); err == nil {
+		t.Error("verified signature from an untrusted CA")
+	}
+	plain, _ := encodeSMIME(t, nil)
+	if _, _, err := v.Verify(plain.Root); err != ErrNotSMIME {
+		t.Errorf("expected ErrNotSMIME, got %v", err)
+	}
+
+	enc := testEncoder()
+	enc.SMIME = &SMIME{Key: certs.rsa.Key}
+	if _, err := enc.Encode(new(bytes.Buffer), &dummyEmail); err != errSMIMECertificate {
+		t.Errorf("expected errSMIMECertificate, got %v", err)
+	}
+}
+
+func TestSMIME_Encrypt(t *testing.T) {
+	certs := newSMIMECerts(t)
+	v := SMIMEVerifier{Roots: certs.roots, Now: testEncoder().Now}
+
+	e, raw := encodeSMIME(t, &SMIME{Recipients: []*x509.Certificate{certs.rsa.Certificate}})
+	if e.Root.MediaType != "application/pkcs7-mime" || e.Root.Params["smime-type"] != "enveloped-data" {
+		t.Fatalf("wrong root %s %v", e.Root.MediaType, e.Root.Params)
+	}
+	if bytes.Contains(raw, []byte("Fancy")) {
+		t.Error("encrypted message contains the body in the clear")
+	}
+	inner, err := certs.rsa.Decrypt(e.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.MediaType != "multipart/alternative" || !bytes.Contains(inner.Raw, []byte("Fancy")) {
+		t.Errorf("wrong decrypted entity:\n%s", inner.Raw)
+	}
+
+	notRecipient := &SMIME{Certificate: certs.ecdsa.Certificate, Key: certs.rsa.Key}
+	if _, err := notRecipient.Decrypt(e.Root); err != ErrNotSMIMERecipient {
+		t.Errorf("expected ErrNotSMIMERecipient, got %v", err)
+	}
+	if _, err := certs.ecdsa.Decrypt(e.Root); err == nil {
+		t.Error("decrypted with an ECDSA key")
+	}
+	noCert := &SMIME{Key: certs.rsa.Key}
+	if _, err := noCert.Decrypt(e.Root); err != errSMIMECertificate {
+		t.Errorf("expected errSMIMECertificate, got %v", err)
+	}
+
+	// Signed, then encrypted.
+	s := *certs.ecdsa
+	s.Recipients = []*x509.Certificate{certs.rsa.Certificate}
+	e, _ = encodeSMIME(t, &s)
+	signed, err := certs.rsa.Decrypt(e.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, chain, err := v.Verify(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.MediaType != "multipart/alternative" || !chain[0].Equal(certs.ecdsa.Certificate) {
+		t.Errorf("wrong result %s signed by %s", inner.MediaType, chain[0].Subject)
+	}
+
+	s.Recipients = []*x509.Certificate{certs.ecdsa.Certificate}
+	enc := testEncoder()
+	enc.SMIME = &s
+	if _, err := enc.Encode(new(bytes.Buffer), &dummyEmail); err != errSMIMERecipientKey {
+		t.Errorf("expected errSMIMERecipientKey, got %v", err)
+	}
+}
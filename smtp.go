@@ -0,0 +1,191 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// ErrNoRecipients is returned when an Email has no addresses in To, CC, or
+// BCC and therefore cannot be sent.
+var ErrNoRecipients = errors.New("email: no recipients given")
+
+// ErrNoAuth is returned when an Auth is given but the server does not support
+// AUTH, as happens when STARTTLS and AUTH are stripped by an attacker. The
+// message is not sent.
+var ErrNoAuth = errors.New("email: server does not support AUTH")
+
+// Send sends the Email through the SMTP server at addr, which must include a
+// port, e.g. "smtp.gmail.com:587". STARTTLS is used if the server advertises
+// it, and a is used to authenticate if it is non-nil, in which case the server
+// must support AUTH.
+//
+// The envelope sender is taken from From and the envelope recipients from To,
+// CC, and BCC. BCC addresses are never written to the message headers.
+func (e *Email) Send(addr string, a smtp.Auth) error {
+	t := SMTPTransport{Addr: addr, Auth: a}
+	return t.Send(context.Background(), nil, e)
+}
+
+// SMTPTransport is a Transport that delivers each message over a new
+// connection to an SMTP server. To reuse connections, see Pool.
+type SMTPTransport struct {
+	// Addr is the address of the server, including a port.
+	Addr string
+
+	// Auth, if non-nil, is used to authenticate. The server must support
+	// AUTH.
+	Auth smtp.Auth
+
+	// TLSConfig is used for STARTTLS. If nil, a default configuration for
+	// Addr's host is used.
+	TLSConfig *tls.Config
+
+	// Encoder, if non-nil, is used to serialize messages.
+	Encoder *Encoder
+}
+
+// Send implements Transport.
+func (t *SMTPTransport) Send(ctx context.Context, env *Envelope, e *Email) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return err
+	}
+	defer watchContext(ctx, conn)()
+
+	c, err := newClient(conn, t.Addr, t.Auth, t.TLSConfig)
+	if err != nil {
+		conn.Close()
+		return ctxErr(ctx, err)
+	}
+	defer c.Close()
+	if _, err := e.send(ctx, c, env, t.Encoder); err != nil {
+		return ctxErr(ctx, err)
+	}
+	return ctxErr(ctx, c.Quit())
+}
+
+// watchContext applies ctx's deadline to conn and interrupts any pending I/O
+// on conn if ctx is canceled. The returned function must be called once conn
+// is no longer in use.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ctxErr returns ctx's error in place of err if ctx has ended, as I/O errors
+// caused by watchContext are less useful to callers.
+func ctxErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	// The connection's deadline may fire just before ctx notices its own.
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// newClient performs the SMTP handshake over conn: EHLO, STARTTLS if the
+// server supports it, and AUTH if a is non-nil.
+func newClient(conn net.Conn, addr string, a smtp.Auth, tc *tls.Config) (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if tc == nil {
+			tc = &tls.Config{ServerName: host}
+		}
+		if err := c.StartTLS(tc); err != nil {
+			return nil, err
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return nil, ErrNoAuth
+		}
+		if err := c.Auth(a); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// send issues MAIL, RCPT, and DATA on c for e. It does not QUIT. If env is
+// nil, e's own envelope is used. If enc is nil, a zero Encoder is used; ctx is
+// passed to it.
+//
+// If the envelope has non-ASCII addresses, the server must support SMTPUTF8,
+// and the message is then written with UTF-8 headers.
+//
+// The message is encoded before the transaction begins, so that a message
+// that cannot be written is never partly delivered. If writing it to the
+// server fails nonetheless, c is closed without ending the message, and
+// dropped is true: ending it would have the server deliver what it has
+// received so far.
+func (e *Email) send(ctx context.Context, c *smtp.Client, env *Envelope, enc *Encoder) (dropped bool, err error) {
+	if env == nil {
+		if env, err = e.Envelope(); err != nil {
+			return false, err
+		}
+	}
+	if len(env.To) == 0 {
+		return false, ErrNoRecipients
+	}
+	var opts Encoder
+	if enc != nil {
+		opts = *enc
+	}
+	if !env.isASCII() {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return false, ErrNonASCIIAddress
+		}
+		opts.SMTPUTF8 = true
+	}
+	var msg bytes.Buffer
+	if _, err := opts.EncodeContext(ctx, &msg, e); err != nil {
+		return false, err
+	}
+
+	// net/smtp asks for SMTPUTF8 whenever the server supports it.
+	if err := c.Mail(env.From); err != nil {
+		return false, err
+	}
+	for _, rcpt := range env.To {
+		if err := c.Rcpt(rcpt); err != nil {
+			return false, err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return false, err
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		c.Close()
+		return true, err
+	}
+	return false, w.Close()
+}
@@ -0,0 +1,400 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// fakeMessage is a message received by fakeServer.
+type fakeMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// fakeServer is a minimal in-process SMTP server used for testing.
+type fakeServer struct {
+	ln   net.Listener
+	tls  *tls.Config // if non-nil, STARTTLS is advertised
+	user string      // if non-empty, AUTH PLAIN is advertised
+	pass string
+	utf8 bool // if true, SMTPUTF8 is advertised
+
+	mu    sync.Mutex
+	msgs  []fakeMessage
+	conns []net.Conn
+	cmds  []string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeServer{ln: ln}
+}
+
+func (s *fakeServer) Addr() string { return s.ln.Addr().String() }
+
+func (s *fakeServer) Close() error { return s.ln.Close() }
+
+func (s *fakeServer) Serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// dials returns how many connections have been accepted.
+func (s *fakeServer) dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// dropConns abruptly closes every accepted connection.
+func (s *fakeServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *fakeServer) messages() []fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMessage(nil), s.msgs...)
+}
+
+func (s *fakeServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP fake")
+
+	var (
+		msg    fakeMessage
+		secure bool
+	)
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(line)
+		if i := strings.IndexAny(verb, " :"); i >= 0 {
+			verb = verb[:i]
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, verb)
+		s.mu.Unlock()
+
+		switch verb {
+		case "EHLO", "HELO":
+			ext := []string{"250-localhost"}
+			if s.tls != nil && !secure {
+				ext = append(ext, "250-STARTTLS")
+			}
+			if s.user != "" {
+				ext = append(ext, "250-AUTH PLAIN")
+			}
+			if s.utf8 {
+				ext = append(ext, "250-SMTPUTF8")
+			}
+			ext = append(ext, "250 8BITMIME")
+			for _, l := range ext {
+				tp.PrintfLine("%s", l)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tc, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			f := strings.Fields(line)
+			if len(f) != 3 {
+				tp.PrintfLine("501 syntax")
+				continue
+			}
+			cred, _ := base64.StdEncoding.DecodeString(f[2])
+			if string(cred) != "\x00"+s.user+"\x00"+s.pass {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			msg = fakeMessage{from: pathArg(line)}
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			msg.to = append(msg.to, pathArg(line))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = data
+			s.mu.Lock()
+			s.msgs = append(s.msgs, msg)
+			s.mu.Unlock()
+			msg = fakeMessage{}
+			tp.PrintfLine("250 queued")
+		case "RSET":
+			msg = fakeMessage{}
+			tp.PrintfLine("250 ok")
+		case "NOOP":
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+// pathArg returns the address within the angle brackets of a MAIL or RCPT
+// command.
+func pathArg(line string) string {
+	i := strings.IndexByte(line, '<')
+	j := strings.LastIndexByte(line, '>')
+	if i < 0 || j < i {
+		return ""
+	}
+	return line[i+1 : j]
+}
+
+// testTLSConfigs returns a server config with a self-signed certificate for
+// 127.0.0.1 and a client config that trusts it.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+	return server, client
+}
+
+func TestEmail_Send(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	go s.Serve()
+
+	e := dummyEmail
+	if err := e.Send(s.Addr(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := s.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	m := msgs[0]
+	if m.from != "test@gmail.com" {
+		t.Errorf("wrong envelope sender: %q", m.from)
+	}
+	want := []string{
+		"test@example.com",
+		"test_cc@example.com",
+		"test_bcc@example.com",
+		"test2_bcc@example.com",
+	}
+	if !reflect.DeepEqual(m.to, want) {
+		t.Errorf("wrong envelope recipients:\nwant: %q\ngot : %q", want, m.to)
+	}
+
+	got, err := New(bytes.NewReader(m.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != e.Subject {
+		t.Errorf("wrong subject: %q", got.Subject)
+	}
+	if len(got.BCC) != 0 || bytes.Contains(m.data, []byte("bcc@")) {
+		t.Error("BCC addresses leaked into the message")
+	}
+}
+
+func TestEmail_SendSTARTTLSAuth(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	var client *tls.Config
+	s.tls, client = testTLSConfigs(t)
+	s.user, s.pass = "user", "secret"
+	go s.Serve()
+
+	e := dummyEmail
+	tr := SMTPTransport{
+		Addr:      s.Addr(),
+		Auth:      smtp.PlainAuth("", "user", "secret", "127.0.0.1"),
+		TLSConfig: client,
+	}
+	if err := tr.Send(context.Background(), nil, &e); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.messages()); n != 1 {
+		t.Fatalf("expected 1 message, got %d", n)
+	}
+
+	cmds := strings.Join(s.commands(), " ")
+	if !strings.HasPrefix(cmds, "EHLO STARTTLS EHLO AUTH MAIL") {
+		t.Errorf("unexpected command sequence: %s", cmds)
+	}
+
+	tr.Auth = smtp.PlainAuth("", "user", "wrong", "127.0.0.1")
+	if err := tr.Send(context.Background(), nil, &e); err == nil {
+		t.Error("expected authentication failure")
+	}
+
+	// A server that does not offer AUTH, as after a downgrade, is refused.
+	plain := newFakeServer(t)
+	defer plain.Close()
+	go plain.Serve()
+	tr.Addr = plain.Addr()
+	if err := tr.Send(context.Background(), nil, &e); err != ErrNoAuth {
+		t.Errorf("expected ErrNoAuth, got %v", err)
+	}
+	if n := len(plain.messages()); n != 0 {
+		t.Errorf("expected no messages, got %d", n)
+	}
+}
+
+func TestEmail_SendEncodeError(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	go s.Serve()
+
+	errRead := errors.New("read failed")
+	p := NewPool(s.Addr(), 1, nil)
+	defer p.Close()
+	for _, modify := range []func(e *Email){
+		func(e *Email) {
+			e.Attachments = []Attachment{{Name: "a.pdf", Body: ioutil.NopCloser(iotest.ErrReader(errRead))}}
+		},
+		func(e *Email) { e.Headers = textproto.MIMEHeader{"X-Bad": {"a\r\nBcc: evil@example.com"}} },
+	} {
+		e := dummyEmail
+		modify(&e)
+		if err := e.Send(s.Addr(), nil); err == nil {
+			t.Error("Send: expected an error")
+		}
+		if err := p.Send(&e, 5*time.Second); err == nil {
+			t.Error("Pool.Send: expected an error")
+		}
+	}
+	if n := len(s.messages()); n != 0 {
+		t.Fatalf("expected no messages, got %d", n)
+	}
+	for _, cmd := range s.commands() {
+		if cmd == "MAIL" || cmd == "DATA" {
+			t.Fatalf("transaction started for a message that cannot be written: %q", s.commands())
+		}
+	}
+
+	e := dummyEmail
+	if err := p.Send(&e, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.messages()); n != 1 {
+		t.Fatalf("expected 1 message, got %d", n)
+	}
+}
+
+func TestEmail_SendNoRecipients(t *testing.T) {
+	e := Email{From: "test@example.com"}
+	if _, err := e.Envelope(); err != ErrNoRecipients {
+		t.Fatalf("expected ErrNoRecipients, got %v", err)
+	}
+}
+
+func TestEmail_SendSMTPUTF8(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	go s.Serve()
+
+	e := Email{
+		From: "Jörg <jörg@example.com>",
+		To:   []string{"用户@例子.广告"},
+		Text: []byte("hi"),
+	}
+	if err := e.Send(s.Addr(), nil); err != ErrNonASCIIAddress {
+		t.Fatalf("expected ErrNonASCIIAddress, got %v", err)
+	}
+
+	s = newFakeServer(t)
+	defer s.Close()
+	s.utf8 = true
+	go s.Serve()
+	if err := e.Send(s.Addr(), nil); err != nil {
+		t.Fatal(err)
+	}
+	msgs := s.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if want := []string{"用户@例子.广告"}; !reflect.DeepEqual(msgs[0].to, want) {
+		t.Errorf("wrong envelope recipients: %q", msgs[0].to)
+	}
+	if !bytes.Contains(msgs[0].data, []byte("From: Jörg <jörg@example.com>\n")) {
+		t.Errorf("From not written as UTF-8:\n%s", msgs[0].data)
+	}
+}
@@ -0,0 +1,75 @@
+package email
+
+import (
+	"context"
+	"net/mail"
+)
+
+// Envelope is the SMTP envelope of a message: the return path and the
+// addresses it is delivered to. These may differ from the addresses in the
+// message's headers, as is the case for BCC recipients.
+type Envelope struct {
+	From string   // bare address, e.g. "test@example.com"
+	To   []string // bare addresses
+}
+
+// Transport delivers Emails. Implementations may speak SMTP, hand the message
+// to a local sendmail, drop it into a directory, call an HTTP API, or record
+// it for tests.
+type Transport interface {
+	// Send delivers e to the recipients in env. If env is nil, the envelope
+	// is derived from e with Email.Envelope.
+	Send(ctx context.Context, env *Envelope, e *Email) error
+}
+
+// TransportFunc is an adapter that allows an ordinary function to be used as a
+// Transport.
+type TransportFunc func(ctx context.Context, env *Envelope, e *Email) error
+
+// Send calls f(ctx, env, e).
+func (f TransportFunc) Send(ctx context.Context, env *Envelope, e *Email) error {
+	return f(ctx, env, e)
+}
+
+// Envelope returns the envelope derived from e's fields: the sender is the
+// address in From, and the recipients are every address in To, CC, and BCC.
+func (e *Email) Envelope() (*Envelope, error) {
+	if e.From == "" {
+		return nil, ErrNoFrom
+	}
+	addr, err := mail.ParseAddress(e.From)
+	if err != nil {
+		return nil, err
+	}
+	env := Envelope{From: addr.Address}
+
+	for _, list := range [...][]string{e.To, e.CC, e.BCC} {
+		for _, s := range list {
+			addrs, err := mail.ParseAddressList(s)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range addrs {
+				env.To = append(env.To, a.Address)
+			}
+		}
+	}
+	if len(env.To) == 0 {
+		return nil, ErrNoRecipients
+	}
+	return &env, nil
+}
+
+// isASCII reports whether every address in env is ASCII. Other addresses can
+// only be sent with the SMTPUTF8 extension.
+func (env *Envelope) isASCII() bool {
+	if !isPrintableASCII(env.From) {
+		return false
+	}
+	for _, a := range env.To {
+		if !isPrintableASCII(a) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package email
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	_ Transport = (*SMTPTransport)(nil)
+	_ Transport = TransportFunc(nil)
+)
+
+func TestEmail_Envelope(t *testing.T) {
+	e := Email{
+		From: `"Foo Bar" <foo@example.com>`,
+		To:   []string{"a@example.com, B <b@example.com>"},
+		CC:   []string{"c@example.com"},
+		BCC:  []string{"<d@example.com>"},
+	}
+	env, err := e.Envelope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Envelope{
+		From: "foo@example.com",
+		To: []string{
+			"a@example.com",
+			"b@example.com",
+			"c@example.com",
+			"d@example.com",
+		},
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Fatalf("wrong envelope:\nwant: %+v\ngot : %+v", want, env)
+	}
+
+	e.From = "not an address"
+	if _, err := e.Envelope(); err == nil {
+		t.Fatal("expected an error for an invalid From")
+	}
+}
+
+func TestSMTPTransport_Envelope(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	go s.Serve()
+
+	env := &Envelope{From: "bounces@example.com", To: []string{"only@example.com"}}
+	e := dummyEmail
+	tr := SMTPTransport{Addr: s.Addr()}
+	if err := tr.Send(context.Background(), env, &e); err != nil {
+		t.Fatal(err)
+	}
+	msgs := s.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if msgs[0].from != env.From || !reflect.DeepEqual(msgs[0].to, env.To) {
+		t.Fatalf("envelope not used: %q %q", msgs[0].from, msgs[0].to)
+	}
+}
+
+func TestSMTPTransport_Canceled(t *testing.T) {
+	// A server that accepts connections but never greets.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	e := dummyEmail
+	tr := SMTPTransport{Addr: ln.Addr().String()}
+	if err := tr.Send(ctx, nil, &e); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestPool_Transport(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	go s.Serve()
+
+	p := NewPool(s.Addr(), 1, nil)
+	defer p.Close()
+
+	var tr Transport = p.Transport()
+	e := dummyEmail
+	env := &Envelope{From: "bounces@example.com", To: []string{"only@example.com"}}
+	if err := tr.Send(context.Background(), env, &e); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := s.messages(); len(msgs) != 1 || msgs[0].from != env.From {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+}
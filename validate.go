@@ -0,0 +1,283 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrNoFrom is returned when an Email has no From address.
+	ErrNoFrom = errors.New("email: 'From' field cannot be empty")
+
+	// ErrDuplicateRecipient is reported by Validate for an address that
+	// already occurs in To, CC, or BCC.
+	ErrDuplicateRecipient = errors.New("email: duplicate recipient")
+
+	// ErrNoBody is reported by Validate for an Email with no body and no
+	// attachments.
+	ErrNoBody = errors.New("email: no body or attachments")
+
+	// ErrAttachmentTooLarge is reported by Validate for an attachment larger
+	// than the Validator allows.
+	ErrAttachmentTooLarge = errors.New("email: attachment too large")
+
+	// ErrLineTooLong is reported by Validate for a header field with a line
+	// longer than RFC 5322, section 2.1.1 allows, even when folded.
+	ErrLineTooLong = errors.New("email: header line longer than 998 characters")
+)
+
+// DefaultMaxAttachmentSize is the largest attachment a Validator allows by
+// default. It is the limit of common mail providers.
+const DefaultMaxAttachmentSize = 25 << 20 // 25 MB
+
+// FieldError is a problem with one field of an Email, as reported by
+// Validate.
+type FieldError struct {
+	// Field is the name of the Email field with the problem, e.g. "To" or
+	// "Attachments". A missing body is reported on "Text".
+	Field string
+
+	// Index is the position of the offending value within the field, for
+	// fields that hold more than one, or -1. In Headers, it is the position
+	// among the values of the header field named by Header.
+	Index int
+
+	// Header is the name of the header field with the problem, as it is
+	// keyed in Headers or in the Attachment's Header, or "" for problems
+	// that are not in a header.
+	Header string
+
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	field := e.Field
+	switch {
+	case e.Header != "" && e.Field == "Headers":
+		field = fmt.Sprintf("%s[%q][%d]", field, e.Header, e.Index)
+	case e.Header != "":
+		field = fmt.Sprintf("%s[%d].Header[%q]", field, e.Index, e.Header)
+	case e.Index >= 0:
+		field = fmt.Sprintf("%s[%d]", field, e.Index)
+	}
+	return "email: " + field + ": " + strings.TrimPrefix(e.Err.Error(), "email: ")
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is the error returned by Validate. It lists every problem
+// found, in the order of the Email's fields.
+type ValidationErrors []*FieldError
+
+func (e ValidationErrors) Error() string {
+	s := make([]string, len(e))
+	for i, fe := range e {
+		s[i] = fe.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Is reports whether any of the errors matches target, so that errors.Is
+// matches them even on Go versions before 1.20, which do not call Unwrap.
+func (e ValidationErrors) Is(target error) bool {
+	for _, fe := range e {
+		if errors.Is(fe, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target, as errors.As does,
+// so that errors.As matches them even on Go versions before 1.20.
+func (e ValidationErrors) As(target interface{}) bool {
+	for _, fe := range e {
+		if errors.As(fe, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the errors.
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, fe := range e {
+		errs[i] = fe
+	}
+	return errs
+}
+
+// Validator holds options for checking Emails before they are sent. The zero
+// value is ready to use and behaves like Email.Validate.
+type Validator struct {
+	// MaxAttachmentSize is the largest attachment allowed, in bytes. If
+	// zero, DefaultMaxAttachmentSize is used; if negative, there is no
+	// limit.
+	//
+	// The limit is only enforced for attachments whose size can be told
+	// without reading them: those with a Body that is a regular *os.File or
+	// that has a Len method, as *bytes.Reader and *strings.Reader do. Other
+	// attachments, including readers wrapped by ioutil.NopCloser, which
+	// hides their Len method, are not checked.
+	MaxAttachmentSize int64
+
+	// SMTPUTF8, if true, allows non-ASCII addresses, which can only be sent
+	// with Encoder.SMTPUTF8 set.
+	SMTPUTF8 bool
+}
+
+// Validate checks e as Validator.Validate does with the default options.
+func (e *Email) Validate() error {
+	var v Validator
+	return v.Validate(e)
+}
+
+// Validate checks that e can be written and sent as it is, reporting every
+// problem found rather than just the first. It checks that:
+//
+//   - From is a single valid address, and To, CC, and BCC are valid address
+//     lists with at least one address and no address more than once;
+//   - addresses are ASCII, unless v.SMTPUTF8 is set;
+//   - header fields, including those in Headers and of Attachments, have
+//     valid names and no characters that could inject other fields (see
+//     HeaderError), and have no lines too long to send even when folded;
+//   - there is a body or an attachment; and
+//   - no attachment is larger than v.MaxAttachmentSize. Attachments whose
+//     size cannot be told without reading them are NOT checked; see
+//     MaxAttachmentSize.
+//
+// If there are problems, the error is a ValidationErrors.
+func (v *Validator) Validate(e *Email) error {
+	var errs ValidationErrors
+	report := func(field string, index int, err error) {
+		errs = append(errs, &FieldError{Field: field, Index: index, Err: err})
+	}
+
+	if e.From == "" {
+		report("From", -1, ErrNoFrom)
+	} else if _, err := mail.ParseAddress(e.From); err != nil {
+		report("From", -1, err)
+	} else {
+		v.checkField(from, e.From, func(err error) { report("From", -1, err) })
+	}
+
+	seen := make(map[string]bool)
+	n := 0
+	for _, f := range [...]struct {
+		field, name string
+		values      []string
+	}{
+		{"To", to, e.To},
+		{"CC", cc, e.CC},
+		{"BCC", bcc, e.BCC},
+	} {
+		for i, s := range f.values {
+			addrs, err := mail.ParseAddressList(s)
+			if err != nil {
+				report(f.field, i, err)
+				continue
+			}
+			for _, a := range addrs {
+				n++
+				if key := strings.ToLower(a.Address); seen[key] {
+					report(f.field, i, ErrDuplicateRecipient)
+				} else {
+					seen[key] = true
+				}
+			}
+			v.checkField(f.name, s, func(err error) { report(f.field, i, err) })
+		}
+	}
+	if n == 0 {
+		report("To", -1, ErrNoRecipients)
+	}
+
+	if e.Subject != "" {
+		v.checkField(subject, e.Subject, func(err error) { report("Subject", -1, err) })
+	}
+	checkHeader(v, e.Headers, func(name string, index int, err error) {
+		errs = append(errs, &FieldError{Field: "Headers", Index: index, Header: name, Err: err})
+	})
+
+	if len(e.Text) == 0 && len(e.HTML) == 0 && len(e.Attachments) == 0 && !e.writesRoot() {
+		report("Text", -1, ErrNoBody)
+	}
+	max := v.MaxAttachmentSize
+	if max == 0 {
+		max = DefaultMaxAttachmentSize
+	}
+	for i, a := range e.Attachments {
+		checkHeader(v, a.Header, func(name string, _ int, err error) {
+			errs = append(errs, &FieldError{Field: "Attachments", Index: i, Header: name, Err: err})
+		})
+		if size, ok := readerSize(a.Body); ok && max > 0 && size > max {
+			report("Attachments", i, ErrAttachmentTooLarge)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkHeader checks each field of h with v.checkField, in sorted order,
+// calling report with the field's name and the position of the value among
+// its values.
+func checkHeader(v *Validator, h textproto.MIMEHeader, report func(name string, index int, err error)) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for i, value := range h[name] {
+			v.checkField(name, value, func(err error) { report(name, i, err) })
+		}
+	}
+}
+
+// checkField calls report for each problem that writing the header field
+// name: value would have.
+func (v *Validator) checkField(name, value string, report func(error)) {
+	if err := checkField(name, value); err != nil {
+		report(err)
+		return
+	}
+	enc, err := encodeField(textproto.CanonicalMIMEHeaderKey(name), value, v.SMTPUTF8)
+	if err != nil {
+		report(err)
+		return
+	}
+	for _, line := range strings.Split(foldHeader(name, enc), lineEnding) {
+		if len(line) > maxFieldLine {
+			report(ErrLineTooLong)
+			return
+		}
+	}
+}
+
+// readerSize returns the number of bytes left in r, if that can be told
+// without reading it.
+func readerSize(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case *os.File:
+		if fi, err := r.Stat(); err == nil && fi.Mode().IsRegular() {
+			if off, err := r.Seek(0, io.SeekCurrent); err == nil {
+				return fi.Size() - off, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,121 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"testing"
+)
+
+// sizedBody is an attachment body whose size is known without reading it.
+type sizedBody struct {
+	*bytes.Reader
+}
+
+func (sizedBody) Close() error { return nil }
+
+func TestEmail_Validate(t *testing.T) {
+	e := dummyEmail
+	if err := e.Validate(); err != nil {
+		t.Fatalf("valid email: %v", err)
+	}
+
+	e = Email{
+		From:    "not an address",
+		To:      []string{"a@example.com", "b@example.com, <broken"},
+		CC:      []string{"B <A@example.com>"},
+		BCC:     []string{"jöhn@example.com"},
+		Subject: "Hi\r\nBcc: victim@example.com",
+		Headers: map[string][]string{
+			"X-Long": {"ok", strings.Repeat("x", 1000)},
+			"X-Bad:": {"a"},
+		},
+		Attachments: []Attachment{{
+			Name:   "big.bin",
+			Header: map[string][]string{"X-Note": {"a\nb"}},
+			Body:   sizedBody{bytes.NewReader(make([]byte, 100))},
+		}},
+	}
+	want := []struct {
+		field  string
+		index  int
+		header string
+		err    error
+	}{
+		{"From", -1, "", nil},
+		{"To", 1, "", nil},
+		{"CC", 0, "", ErrDuplicateRecipient},
+		{"BCC", 0, "", ErrNonASCIIAddress},
+		{"Subject", -1, "", nil},
+		{"Headers", -1, "X-Bad:", nil},
+		{"Headers", 1, "X-Long", ErrLineTooLong},
+		{"Attachments", 0, "X-Note", nil},
+		{"Attachments", 0, "", ErrAttachmentTooLarge},
+	}
+	v := Validator{MaxAttachmentSize: 99}
+	err := v.Validate(&e)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %d: %v", len(want), len(errs), err)
+	}
+	for i, w := range want {
+		got := errs[i]
+		if got.Field != w.field || (w.index >= 0 && got.Index != w.index) || got.Header != w.header || (w.err != nil && !errors.Is(got, w.err)) {
+			t.Errorf("error %d: expected %s[%d] %q %v, got %v", i, w.field, w.index, w.header, w.err, got)
+		}
+	}
+	var he *HeaderError
+	if !errors.As(err, &he) || he.Field != subject {
+		t.Errorf("expected HeaderError for Subject, got %v", he)
+	}
+	if !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Error("errors.Is does not match ErrAttachmentTooLarge")
+	}
+	// Is and As are called directly, as errors.Is and errors.As do before
+	// Go 1.20.
+	he = nil
+	if !errs.Is(ErrDuplicateRecipient) || errs.Is(ErrNoBody) || !errs.As(&he) || he.Field != subject {
+		t.Errorf("Is and As do not match the errors, got %v", he)
+	}
+	for i, s := range map[int]string{
+		6: `email: Headers["X-Long"][1]: header line longer than 998 characters`,
+		8: "email: Attachments[0]: attachment too large",
+	} {
+		if got := errs[i].Error(); got != s {
+			t.Errorf("wrong message %q", got)
+		}
+	}
+	if s := errs[7].Error(); !strings.HasPrefix(s, `email: Attachments[0].Header["X-Note"]: `) {
+		t.Errorf("wrong message %q", s)
+	}
+
+	v = Validator{SMTPUTF8: true, MaxAttachmentSize: -1}
+	e = Email{BCC: []string{"jöhn@example.com"}}
+	errs = v.Validate(&e).(ValidationErrors)
+	if len(errs) != 2 || !errors.Is(errs[0], ErrNoFrom) || !errors.Is(errs[1], ErrNoBody) {
+		t.Errorf("expected ErrNoFrom and ErrNoBody, got %v", errs)
+	}
+	e = Email{From: "a@example.com", Text: []byte("hi")}
+	if err := e.Validate(); !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("expected ErrNoRecipients, got %v", err)
+	}
+
+	// The size of parsed bodies is told without reading them; that of
+	// bodies wrapped by ioutil.NopCloser is not.
+	big := make([]byte, 100)
+	v = Validator{MaxAttachmentSize: 99}
+	e = dummyEmail
+	e.Attachments = []Attachment{new(Part).attachment(big, new(mime.WordDecoder))}
+	if err := v.Validate(&e); !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Errorf("parsed attachment: expected ErrAttachmentTooLarge, got %v", err)
+	}
+	e.Attachments = []Attachment{{Name: "a.bin", Body: ioutil.NopCloser(bytes.NewReader(big))}}
+	if err := v.Validate(&e); err != nil {
+		t.Errorf("NopCloser attachment: %v", err)
+	}
+}